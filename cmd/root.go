@@ -25,7 +25,7 @@ func Execute() {
 
 func init() {
 	v := viper.GetViper()
-	qproxy.SetCommandFlags(rootCmd.Flags(), v)
+	qproxy.SetCommandFlags(rootCmd.PersistentFlags(), v)
 	cobra.OnInitialize(func() {
 		if err := qproxy.InitConfig(v); err != nil {
 			log.WithFields(log.Fields{"error": err}).Fatal("Unable to start QProxy")
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/empreinte-digitale/qproxy/pkg/qproxy"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Mint a signed bypass token",
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		room, _ := flags.GetString("room")
+		ttl, _ := flags.GetDuration("ttl")
+		uses, _ := flags.GetInt("uses")
+		backend, _ := flags.GetString("backend")
+
+		secretKey := "bypass_tokens.secret"
+		if room != "" && room != "default" {
+			secretKey = "rooms." + room + "." + secretKey
+		}
+
+		token, err := qproxy.MintBypassToken(viper.GetString(secretKey), ttl, uses, backend)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Fatal("Unable to mint bypass token")
+		}
+
+		fmt.Println(token)
+	},
+}
+
+func init() {
+	flags := tokenCmd.Flags()
+	flags.String("room", "", "Room of the token, defaults to the default room")
+	flags.Duration("ttl", 24*time.Hour, "Lifetime of the token")
+	flags.Int("uses", 0, "Maximum admissions allowed by the token, 0 for unlimited")
+	flags.String("backend", "", "Backend the token holders are admitted on, defaults to any backend")
+	rootCmd.AddCommand(tokenCmd)
+}
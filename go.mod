@@ -3,6 +3,8 @@ module github.com/empreinte-digitale/qproxy
 go 1.13
 
 require (
+	github.com/prometheus/client_golang v0.9.3
+	github.com/prometheus/client_model v0.0.0-20190129233127-fd36f4220a90
 	github.com/prometheus/common v0.4.0
 	github.com/rs/xid v1.2.1
 	github.com/sirupsen/logrus v1.4.2
@@ -0,0 +1,365 @@
+package qproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	accessLogFormatJSON     = "json"
+	accessLogFormatCombined = "combined"
+)
+
+const (
+	outcomeAdmitted    = "admitted"
+	outcomeQueued      = "queued"
+	outcomeFull        = "full"
+	outcomeBypassed    = "bypassed"
+	outcomeWhitelisted = "whitelisted"
+	outcomeDenied      = "denied"
+	outcomeHandshake   = "handshake"
+	outcomeChallenge   = "challenge"
+	outcomeQuota       = "quota"
+	outcomeClosed      = "closed"
+)
+
+type accessLogConfig struct {
+	file             string
+	format           string
+	maxSize          int64
+	maxBackups       int
+	queuedSampleRate float64
+}
+
+func newAccessLogConfig(v *viper.Viper) *accessLogConfig {
+	v.SetDefault("access_log.format", accessLogFormatJSON)
+	v.SetDefault("access_log.max_size", 100)
+	v.SetDefault("access_log.max_backups", 5)
+	v.SetDefault("access_log.queued_sample_rate", 1)
+
+	return &accessLogConfig{
+		file:             v.GetString("access_log.file"),
+		format:           v.GetString("access_log.format"),
+		maxSize:          v.GetInt64("access_log.max_size") * 1024 * 1024,
+		maxBackups:       v.GetInt("access_log.max_backups"),
+		queuedSampleRate: v.GetFloat64("access_log.queued_sample_rate"),
+	}
+}
+
+func validateAccessLogConfig(v *viper.Viper) error {
+	format := v.GetString("access_log.format")
+	if format != "" && format != accessLogFormatJSON && format != accessLogFormatCombined {
+		return errors.New("Option `access_log.format` must be `json` or `combined`")
+	}
+
+	if v.GetInt("access_log.max_size") < 0 || v.GetInt("access_log.max_backups") < 0 {
+		return errors.New("Options `access_log.max_size` and `access_log.max_backups` must be greater or equals than 0")
+	}
+
+	if v.IsSet("access_log.queued_sample_rate") {
+		if rate := v.GetFloat64("access_log.queued_sample_rate"); rate < 0 || rate > 1 {
+			return errors.New("Option `access_log.queued_sample_rate` must be between 0 and 1")
+		}
+	}
+
+	return nil
+}
+
+// accessLogEntry describes a request handled by the proxy, it is filled while
+// the request goes through the handler.
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"client_ip"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Room      string    `json:"room"`
+	Pool      string    `json:"pool"`
+	SessionID string    `json:"session_id,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Backend   string    `json:"backend,omitempty"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Latency   float64   `json:"latency"`
+	Queued    float64   `json:"queued,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+func accessLogEntryFromContext(ctx context.Context) *accessLogEntry {
+	entry, _ := ctx.Value(accessLogEntryKey).(*accessLogEntry)
+
+	return entry
+}
+
+func (entry *accessLogEntry) setOutcome(outcome string) {
+	if entry != nil {
+		entry.Outcome = outcome
+	}
+}
+
+// setURI replaces the logged URI, once bypass tokens or invitation codes have
+// been removed from it. Handlers may receive a copy of the logged request, so
+// its URI is not read back.
+func (entry *accessLogEntry) setURI(uri string) {
+	if entry != nil {
+		entry.URI = uri
+	}
+}
+
+func (entry *accessLogEntry) setRoute(rm *room, p *pool) {
+	if entry != nil {
+		entry.Room = rm.name
+		entry.Pool = p.name
+	}
+}
+
+// setSession records the session and the backend serving the request, the
+// time spent queued so far is recorded for queued sessions.
+func (entry *accessLogEntry) setSession(s *session, b *backend) {
+	if entry == nil {
+		return
+	}
+
+	if b != nil {
+		entry.Backend = b.name
+	}
+
+	if s == nil {
+		return
+	}
+
+	entry.SessionID = s.id
+	if b == nil {
+		entry.Queued = time.Since(s.created).Seconds()
+	} else {
+		entry.Queued = s.queueWait().Seconds()
+	}
+}
+
+func (entry *accessLogEntry) combined() string {
+	backend := entry.Backend
+	if backend == "" {
+		backend = "-"
+	}
+
+	return fmt.Sprintf("%s - - [%s] %q %d %d %q %q outcome=%s backend=%s latency=%.3f queued=%.3f\n",
+		entry.ClientIP,
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method+" "+entry.URI+" "+entry.Proto,
+		entry.Status,
+		entry.Bytes,
+		entry.Referer,
+		entry.UserAgent,
+		entry.Outcome,
+		backend,
+		entry.Latency,
+		entry.Queued,
+	)
+}
+
+// accessLog writes the access log entries to a file rotated by size, it may be
+// reconfigured and reopened while requests are served.
+type accessLog struct {
+	atomicConfig atomic.Value
+	lock         sync.Mutex
+	file         *rotatingFile
+}
+
+func newAccessLog() *accessLog {
+	l := accessLog{}
+	l.atomicConfig.Store(&accessLogConfig{})
+
+	return &l
+}
+
+func (l *accessLog) config() *accessLogConfig {
+	return l.atomicConfig.Load().(*accessLogConfig)
+}
+
+func (l *accessLog) enabled() bool {
+	return l.config().file != ""
+}
+
+// configure applies a new configuration, the file is opened again when its
+// path changes.
+func (l *accessLog) configure(config *accessLogConfig) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file != nil && l.file.path != config.file {
+		l.file.close()
+		l.file = nil
+	}
+
+	if l.file == nil && config.file != "" {
+		file, err := openRotatingFile(config.file)
+		if err != nil {
+			return err
+		}
+		l.file = file
+	}
+
+	if l.file != nil {
+		l.file.maxSize = config.maxSize
+		l.file.maxBackups = config.maxBackups
+	}
+	l.atomicConfig.Store(config)
+
+	return nil
+}
+
+// reopen opens the file again, after it has been moved by an external tool.
+func (l *accessLog) reopen() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	return l.file.reopen()
+}
+
+func (l *accessLog) write(entry *accessLogEntry) error {
+	config := l.config()
+	if entry.Outcome == outcomeQueued && config.queuedSampleRate < 1 && rand.Float64() >= config.queuedSampleRate {
+		return nil
+	}
+
+	var line []byte
+	if config.format == accessLogFormatCombined {
+		line = []byte(entry.combined())
+	} else {
+		var err error
+		if line, err = json.Marshal(entry); err != nil {
+			return err
+		}
+		line = append(line, '\n')
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return nil
+	}
+
+	return l.file.write(line)
+}
+
+// rotatingFile is a file moved to `{path}.1` once it exceeds maxSize bytes,
+// older files are shifted up to `{path}.{maxBackups}`.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string) (*rotatingFile, error) {
+	f := rotatingFile{path: path}
+	if err := f.reopen(); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func (f *rotatingFile) reopen() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.close()
+	f.file = file
+	f.size = info.Size()
+
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	f.close()
+	for i := f.maxBackups - 1; i > 0; i-- {
+		os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+	}
+
+	var err error
+	if f.maxBackups > 0 {
+		err = os.Rename(f.path, f.path+".1")
+	} else {
+		err = os.Remove(f.path)
+	}
+
+	if reopenErr := f.reopen(); reopenErr != nil {
+		return reopenErr
+	}
+
+	return err
+}
+
+func (f *rotatingFile) write(b []byte) error {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil && f.file == nil {
+			return err
+		}
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+
+	return err
+}
+
+func (f *rotatingFile) close() {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+}
+
+// serveLogged serves the request with the handler and writes its access log
+// entry.
+func (l *accessLog) serveLogged(rw http.ResponseWriter, r *http.Request, clientIP string, handler func(http.ResponseWriter, *http.Request)) {
+	entry := &accessLogEntry{
+		Time:      time.Now(),
+		ClientIP:  clientIP,
+		Method:    r.Method,
+		Host:      r.Host,
+		URI:       r.RequestURI,
+		Proto:     r.Proto,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+	recorder := newResponseRecorder(rw)
+	r = r.WithContext(context.WithValue(r.Context(), accessLogEntryKey, entry))
+	handler(recorder, r)
+
+	entry.Status = recorder.status
+	entry.Bytes = recorder.bytes
+	entry.Latency = time.Since(entry.Time).Seconds()
+	if err := l.write(entry); err != nil {
+		proxyLog.WithFields(log.Fields{"error": err}).Error("Unable to write access log")
+	}
+}
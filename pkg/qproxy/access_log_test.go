@@ -0,0 +1,166 @@
+package qproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	f, err := openRotatingFile(path)
+	require.NoError(t, err)
+	f.maxSize = 10
+	f.maxBackups = 2
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		require.NoError(t, f.write([]byte(line)))
+	}
+	f.close()
+
+	for file, content := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		b, err := ioutil.ReadFile(path + file)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(b))
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(dir, "access.log")
+	v := newViper()
+	v.Set("backends.test.url", upstream.URL)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("access_log.file", path)
+	require.NoError(t, ValidateProxyConfig(v))
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	handler := newProxyHandler(qp)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page?a=1", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page", nil))
+
+	v.Set("access_log.queued_sample_rate", 0)
+	require.NoError(t, qp.config.loadDynamicConfig())
+	require.NoError(t, qp.accessLog.configure(qp.config.getAccessLogConfig()))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page", nil))
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 2)
+
+	var admitted, queued accessLogEntry
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &admitted))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &queued))
+
+	assert.Equal(t, "192.0.2.1", admitted.ClientIP)
+	assert.Equal(t, "/page?a=1", admitted.URI)
+	assert.Equal(t, outcomeAdmitted, admitted.Outcome)
+	assert.Equal(t, "test", admitted.Backend)
+	assert.Equal(t, http.StatusOK, admitted.Status)
+	assert.Equal(t, int64(5), admitted.Bytes)
+	assert.NotEmpty(t, admitted.SessionID)
+	assert.NotEmpty(t, admitted.RequestID)
+
+	assert.Equal(t, outcomeQueued, queued.Outcome)
+	assert.Empty(t, queued.Backend)
+	assert.NotEmpty(t, queued.SessionID)
+
+	v.Set("access_log.format", "other")
+	assert.EqualError(t, ValidateProxyConfig(v), "Option `access_log.format` must be `json` or `combined`")
+}
+
+func TestAccessLogTracing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	codes := filepath.Join(dir, "codes.txt")
+	require.NoError(t, ioutil.WriteFile(codes, []byte("VIP\n"), 0600))
+
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer collector.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(dir, "access.log")
+	v := newViper()
+	v.Set("backends.test.url", upstream.URL)
+	v.Set("backends.test.max_sessions", 2)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("access_log.file", path)
+	v.Set("tracing.endpoint", collector.URL+"/v1/traces")
+	v.Set("bypass_tokens.secret", "secret")
+	v.Set("invitations.file", codes)
+	v.Set("invitations.reserved_share", 0.5)
+	require.NoError(t, ValidateProxyConfig(v))
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	handler := newProxyHandler(qp)
+
+	token, err := MintBypassToken("secret", time.Hour, 1, "")
+	require.NoError(t, err)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page?qp_token="+token+"&a=1", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page?qp_invite=VIP&a=2", nil))
+	qp.tracer.shutdown()
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 2)
+
+	var tokenEntry, invitationEntry accessLogEntry
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &tokenEntry))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &invitationEntry))
+	assert.Equal(t, "/page?a=1", tokenEntry.URI)
+	assert.Equal(t, "/page?a=2", invitationEntry.URI)
+	assert.Equal(t, outcomeAdmitted, invitationEntry.Outcome)
+	assert.NotContains(t, string(b), token)
+	assert.NotContains(t, string(b), "VIP")
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	entry := &accessLogEntry{
+		ClientIP:  "192.0.2.1",
+		Method:    "GET",
+		URI:       "/",
+		Proto:     "HTTP/1.1",
+		UserAgent: "firefox",
+		Outcome:   outcomeQueued,
+		Status:    200,
+		Bytes:     12,
+		Queued:    1.5,
+	}
+
+	assert.Contains(t, entry.combined(), `192.0.2.1 - - [`)
+	assert.Contains(t, entry.combined(), `] "GET / HTTP/1.1" 200 12 "" "firefox" outcome=queued backend=- latency=0.000 queued=1.500`)
+}
@@ -0,0 +1,396 @@
+package qproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	alertMetricQueuedSessions = "queued_sessions"
+	alertMetricBackendsFull   = "backends_full"
+	// alertMetricBackendErrors is the highest rate, per minute, of the upstream
+	// errors of the backends of the pool, not a health state of the backends.
+	alertMetricBackendErrors = "backend_errors"
+	alertMetricQueueFullRate = "queue_full_rate"
+
+	alertStatusFiring   = "firing"
+	alertStatusResolved = "resolved"
+
+	alertNotifyTimeout = 30 * time.Second
+)
+
+// alertRule fires when its metric stays above threshold during forDuration in
+// a pool, and resolves once the metric falls to clearThreshold or below.
+type alertRule struct {
+	name           string
+	metric         string
+	room           string
+	pool           string
+	threshold      float64
+	clearThreshold float64
+	forDuration    time.Duration
+	repeatInterval time.Duration
+	webhook        string
+	command        []string
+}
+
+type rawAlertRule struct {
+	Name           string   `mapstructure:"name"`
+	Metric         string   `mapstructure:"metric"`
+	Room           string   `mapstructure:"room"`
+	Pool           string   `mapstructure:"pool"`
+	Threshold      float64  `mapstructure:"threshold"`
+	ClearThreshold *float64 `mapstructure:"clear_threshold"`
+	For            int      `mapstructure:"for"`
+	RepeatInterval int      `mapstructure:"repeat_interval"`
+	Webhook        string   `mapstructure:"webhook"`
+	Command        string   `mapstructure:"command"`
+}
+
+func newAlertRules(v *viper.Viper) ([]*alertRule, error) {
+	rawRules := make([]rawAlertRule, 0)
+	if err := v.UnmarshalKey("alerts", &rawRules); err != nil {
+		return nil, err
+	}
+
+	rules := make([]*alertRule, 0)
+	names := make(map[string]bool)
+	for i, rawRule := range rawRules {
+		name := rawRule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		// Alert states are kept by rule name.
+		if names[name] {
+			return nil, fmt.Errorf("[alert: %s] Option `name` must be unique", name)
+		}
+		names[name] = true
+
+		switch rawRule.Metric {
+		case alertMetricQueuedSessions, alertMetricBackendsFull, alertMetricBackendErrors, alertMetricQueueFullRate:
+		default:
+			return nil, fmt.Errorf("[alert: %s] Option `metric` must be `%s`, `%s`, `%s` or `%s`", name,
+				alertMetricQueuedSessions, alertMetricBackendsFull, alertMetricBackendErrors, alertMetricQueueFullRate)
+		}
+
+		// The command is run without a shell, its arguments are separated by
+		// spaces.
+		command := strings.Fields(rawRule.Command)
+		if rawRule.Webhook == "" && len(command) == 0 {
+			return nil, fmt.Errorf("[alert: %s] Missing `webhook` or `command` option", name)
+		}
+
+		if rawRule.For < 0 || rawRule.RepeatInterval < 0 {
+			return nil, fmt.Errorf("[alert: %s] Options `for` and `repeat_interval` must be greater or equals than 0", name)
+		}
+
+		clearThreshold := rawRule.Threshold
+		if rawRule.ClearThreshold != nil {
+			clearThreshold = *rawRule.ClearThreshold
+		}
+		if clearThreshold > rawRule.Threshold {
+			return nil, fmt.Errorf("[alert: %s] Option `clear_threshold` must be lower or equals than `threshold`", name)
+		}
+
+		rules = append(rules, &alertRule{
+			name:           name,
+			metric:         rawRule.Metric,
+			room:           rawRule.Room,
+			pool:           rawRule.Pool,
+			threshold:      rawRule.Threshold,
+			clearThreshold: clearThreshold,
+			forDuration:    time.Duration(rawRule.For) * time.Second,
+			repeatInterval: time.Duration(rawRule.RepeatInterval) * time.Second,
+			webhook:        rawRule.Webhook,
+			command:        command,
+		})
+	}
+
+	return rules, nil
+}
+
+func validateAlertRules(v *viper.Viper) error {
+	_, err := newAlertRules(v)
+
+	return err
+}
+
+// Alert is sent to the webhook, and to the standard input of the command, of
+// a rule when it fires, while it keeps firing and when it resolves.
+type Alert struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	Metric    string    `json:"metric"`
+	Room      string    `json:"room"`
+	Pool      string    `json:"pool"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Since     time.Time `json:"since"`
+	Time      time.Time `json:"time"`
+}
+
+// alertState is the state of a rule in a pool.
+type alertState struct {
+	pendingSince time.Time
+	firing       bool
+	notified     time.Time
+}
+
+// alertSample holds the counters of a pool at the previous evaluation, used to
+// compute rates.
+type alertSample struct {
+	time                time.Time
+	queueFullRejections uint64
+	upstreamErrors      map[string]uint64
+}
+
+// alerting evaluates the alert rules at each refresh tick.
+type alerting struct {
+	lock    sync.Mutex
+	states  map[string]*alertState
+	samples map[string]*alertSample
+	notify  func(rule *alertRule, alert *Alert)
+}
+
+func newAlerting() *alerting {
+	a := alerting{
+		states:  make(map[string]*alertState),
+		samples: make(map[string]*alertSample),
+	}
+	a.notify = a.send
+
+	return &a
+}
+
+// evaluate updates the state of the rules for each pool and sends the
+// notifications, rules are evaluated on pools matching their room and pool
+// options.
+func (a *alerting) evaluate(rules []*alertRule, rooms []*room) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(rules) == 0 {
+		a.states = make(map[string]*alertState)
+		a.samples = make(map[string]*alertSample)
+		return
+	}
+
+	now := time.Now()
+	states := make(map[string]*alertState)
+	samples := make(map[string]*alertSample)
+	for _, room := range rooms {
+		for _, pool := range room.pools() {
+			key := room.name + "/" + pool.name
+			statistics := pool.syncStatistics()
+			sample := newAlertSample(now, statistics)
+			samples[key] = sample
+
+			values := alertValues(statistics, sample, a.samples[key])
+			for _, rule := range rules {
+				if (rule.room != "" && rule.room != room.name) || (rule.pool != "" && rule.pool != pool.name) {
+					continue
+				}
+
+				stateKey := rule.name + "/" + key
+				state, ok := a.states[stateKey]
+				if !ok {
+					state = &alertState{}
+				}
+				states[stateKey] = state
+				a.update(rule, state, room.name, pool.name, values[rule.metric], now)
+			}
+		}
+	}
+
+	a.states = states
+	a.samples = samples
+}
+
+func (a *alerting) update(rule *alertRule, state *alertState, roomName string, poolName string, value float64, now time.Time) {
+	alert := &Alert{
+		Name:      rule.name,
+		Metric:    rule.metric,
+		Room:      roomName,
+		Pool:      poolName,
+		Value:     value,
+		Threshold: rule.threshold,
+		Since:     state.pendingSince,
+		Time:      now,
+	}
+
+	if state.firing {
+		if value <= rule.clearThreshold {
+			state.firing = false
+			state.pendingSince = time.Time{}
+			alert.Status = alertStatusResolved
+			a.notify(rule, alert)
+			return
+		}
+
+		if rule.repeatInterval > 0 && now.Sub(state.notified) >= rule.repeatInterval {
+			state.notified = now
+			alert.Status = alertStatusFiring
+			a.notify(rule, alert)
+		}
+		return
+	}
+
+	if value <= rule.threshold {
+		state.pendingSince = time.Time{}
+		return
+	}
+
+	if state.pendingSince.IsZero() {
+		state.pendingSince = now
+		alert.Since = now
+	}
+
+	if now.Sub(state.pendingSince) >= rule.forDuration {
+		state.firing = true
+		state.notified = now
+		alert.Status = alertStatusFiring
+		a.notify(rule, alert)
+	}
+}
+
+func newAlertSample(now time.Time, statistics *PoolStatistics) *alertSample {
+	sample := &alertSample{
+		time:                now,
+		queueFullRejections: statistics.QueueFullRejections,
+		upstreamErrors:      make(map[string]uint64),
+	}
+	for _, backend := range statistics.Backends {
+		sample.upstreamErrors[backend.Name] = backend.Traffic.UpstreamErrors
+	}
+
+	return sample
+}
+
+// alertValues computes the value of each metric for a pool, rates are per
+// minute since the previous sample.
+func alertValues(statistics *PoolStatistics, sample *alertSample, previous *alertSample) map[string]float64 {
+	values := map[string]float64{
+		alertMetricQueuedSessions: float64(statistics.QueuedSessions),
+	}
+
+	full := len(statistics.Backends) > 0
+	for _, backend := range statistics.Backends {
+		if backend.Sessions < backend.MaxSessions-backend.MaxReservedSessions {
+			full = false
+		}
+	}
+	if full {
+		values[alertMetricBackendsFull] = 1
+	}
+
+	if previous == nil || !sample.time.After(previous.time) {
+		return values
+	}
+
+	minutes := sample.time.Sub(previous.time).Minutes()
+	values[alertMetricQueueFullRate] = float64(counterDelta(sample.queueFullRejections, previous.queueFullRejections)) / minutes
+	for name, errors := range sample.upstreamErrors {
+		rate := float64(counterDelta(errors, previous.upstreamErrors[name])) / minutes
+		if rate > values[alertMetricBackendErrors] {
+			values[alertMetricBackendErrors] = rate
+		}
+	}
+
+	return values
+}
+
+// counterDelta returns the increase of a counter, which may have been reset.
+func counterDelta(current uint64, previous uint64) uint64 {
+	if current < previous {
+		return current
+	}
+
+	return current - previous
+}
+
+// send runs the notifications of the alert in the background so the refresh
+// loop is never blocked.
+func (a *alerting) send(rule *alertRule, alert *Alert) {
+	proxyLog.WithFields(log.Fields{
+		"alert":  alert.Name,
+		"status": alert.Status,
+		"room":   alert.Room,
+		"pool":   alert.Pool,
+		"value":  alert.Value,
+	}).Warning("Alert " + alert.Status)
+
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		proxyLog.WithFields(log.Fields{"error": err, "alert": alert.Name}).Error("Unable to encode alert")
+		return
+	}
+
+	if rule.webhook != "" {
+		go func() {
+			if err := postAlert(rule.webhook, payload); err != nil {
+				proxyLog.WithFields(log.Fields{"error": err, "alert": alert.Name}).Error("Unable to send alert webhook")
+			}
+		}()
+	}
+
+	if len(rule.command) > 0 {
+		go func() {
+			if err := runAlertCommand(rule.command, alert, payload); err != nil {
+				proxyLog.WithFields(log.Fields{"error": err, "alert": alert.Name}).Error("Unable to run alert command")
+			}
+		}()
+	}
+}
+
+func postAlert(url string, payload []byte) error {
+	client := &http.Client{Timeout: alertNotifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook answered with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// runAlertCommand runs the command with the alert as JSON on its standard
+// input and in `QPROXY_ALERT_*` environment variables.
+func runAlertCommand(command []string, alert *Alert, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), alertNotifyTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		"QPROXY_ALERT_NAME="+alert.Name,
+		"QPROXY_ALERT_STATUS="+alert.Status,
+		"QPROXY_ALERT_METRIC="+alert.Metric,
+		"QPROXY_ALERT_ROOM="+alert.Room,
+		"QPROXY_ALERT_POOL="+alert.Pool,
+		"QPROXY_ALERT_VALUE="+strconv.FormatFloat(alert.Value, 'f', -1, 64),
+		"QPROXY_ALERT_THRESHOLD="+strconv.FormatFloat(alert.Threshold, 'f', -1, 64),
+	)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(output))
+	}
+
+	return nil
+}
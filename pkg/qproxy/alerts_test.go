@@ -0,0 +1,164 @@
+package qproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlertRulesValidation(t *testing.T) {
+	v := newViper()
+	v.Set("alerts", []map[string]interface{}{{"name": "queue", "metric": "unknown", "command": "/bin/true"}})
+	assert.EqualError(t, validateAlertRules(v), "[alert: queue] Option `metric` must be `queued_sessions`, `backends_full`, `backend_errors` or `queue_full_rate`")
+
+	v.Set("alerts", []map[string]interface{}{{"metric": alertMetricQueuedSessions}})
+	assert.EqualError(t, validateAlertRules(v), "[alert: #1] Missing `webhook` or `command` option")
+
+	v.Set("alerts", []map[string]interface{}{{"metric": alertMetricQueuedSessions, "command": "/bin/true", "threshold": 10, "clear_threshold": 20}})
+	assert.EqualError(t, validateAlertRules(v), "[alert: #1] Option `clear_threshold` must be lower or equals than `threshold`")
+
+	v.Set("alerts", []map[string]interface{}{
+		{"name": "queue", "metric": alertMetricQueuedSessions, "command": "/bin/true"},
+		{"name": "queue", "metric": alertMetricBackendsFull, "command": "/bin/true"},
+	})
+	assert.EqualError(t, validateAlertRules(v), "[alert: queue] Option `name` must be unique")
+
+	v.Set("alerts", []map[string]interface{}{{"metric": alertMetricQueuedSessions, "command": "/bin/true", "threshold": 10, "clear_threshold": 5}})
+	assert.NoError(t, validateAlertRules(v))
+
+	v.Set("alerts", []map[string]interface{}{{"metric": alertMetricQueuedSessions, "command": " /usr/local/bin/notify  --channel ops "}})
+	rules, err := newAlertRules(v)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/usr/local/bin/notify", "--channel", "ops"}, rules[0].command)
+}
+
+func TestAlertHysteresis(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("alerts", []map[string]interface{}{{
+		"name":            "queue",
+		"metric":          alertMetricQueuedSessions,
+		"threshold":       1,
+		"clear_threshold": 0,
+		"command":         "/bin/true",
+	}})
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+
+	alerts := make([]*Alert, 0)
+	qp.alerting.notify = func(rule *alertRule, alert *Alert) {
+		alerts = append(alerts, alert)
+	}
+	evaluate := func() {
+		qp.alerting.evaluate(qp.config.getAlertRules(), qp.rooms())
+	}
+
+	pool := qp.defaultRoom().defaultPool()
+	sessions := make([]*session, 0)
+	for i := 0; i < 3; i++ {
+		s, _, ok := pool.syncNewSession("", nil, defaultLaneName, false)
+		require.True(t, ok)
+		sessions = append(sessions, s)
+	}
+
+	evaluate()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, alertStatusFiring, alerts[0].Status)
+	assert.Equal(t, float64(2), alerts[0].Value)
+	assert.Equal(t, defaultRoomName, alerts[0].Room)
+
+	pool.syncRemoveSession(sessions[2].id)
+	evaluate()
+	assert.Len(t, alerts, 1)
+
+	pool.syncRemoveSession(sessions[1].id)
+	evaluate()
+	require.Len(t, alerts, 2)
+	assert.Equal(t, alertStatusResolved, alerts[1].Status)
+}
+
+func TestAlertForAndRepeat(t *testing.T) {
+	a := newAlerting()
+	notified := make([]string, 0)
+	a.notify = func(rule *alertRule, alert *Alert) {
+		notified = append(notified, alert.Status)
+	}
+
+	rule := &alertRule{metric: alertMetricBackendsFull, forDuration: time.Minute, repeatInterval: 5 * time.Minute}
+	state := &alertState{}
+	start := time.Now()
+
+	a.update(rule, state, "default", "default", 1, start)
+	assert.Empty(t, notified)
+	a.update(rule, state, "default", "default", 0, start.Add(30*time.Second))
+	a.update(rule, state, "default", "default", 1, start.Add(40*time.Second))
+	a.update(rule, state, "default", "default", 1, start.Add(90*time.Second))
+	assert.Empty(t, notified)
+
+	a.update(rule, state, "default", "default", 1, start.Add(100*time.Second))
+	a.update(rule, state, "default", "default", 1, start.Add(200*time.Second))
+	a.update(rule, state, "default", "default", 1, start.Add(400*time.Second))
+	a.update(rule, state, "default", "default", 0, start.Add(500*time.Second))
+	assert.Equal(t, []string{alertStatusFiring, alertStatusFiring, alertStatusResolved}, notified)
+}
+
+func TestAlertRates(t *testing.T) {
+	now := time.Now()
+	previous := &alertSample{time: now.Add(-30 * time.Second), queueFullRejections: 10, upstreamErrors: map[string]uint64{"a": 5, "b": 5}}
+	statistics := &PoolStatistics{
+		QueueFullRejections: 40,
+		Backends: []*BackendStatistics{
+			{Name: "a", Sessions: 2, MaxSessions: 2, Traffic: BackendTrafficStatistics{UpstreamErrors: 6}},
+			{Name: "b", Sessions: 1, MaxSessions: 2, Traffic: BackendTrafficStatistics{UpstreamErrors: 3}},
+		},
+	}
+
+	values := alertValues(statistics, newAlertSample(now, statistics), previous)
+	assert.Equal(t, float64(60), values[alertMetricQueueFullRate])
+	assert.Equal(t, float64(6), values[alertMetricBackendErrors])
+	assert.Equal(t, float64(0), values[alertMetricBackendsFull])
+}
+
+func TestAlertNotifications(t *testing.T) {
+	received := make(chan *Alert, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		alert := Alert{}
+		json.NewDecoder(r.Body).Decode(&alert)
+		received <- &alert
+	}))
+	defer webhook.Close()
+
+	dir, err := ioutil.TempDir("", "qproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "output")
+	command := filepath.Join(dir, "alert.sh")
+	require.NoError(t, ioutil.WriteFile(command, []byte("#!/bin/sh\necho \"$1 $QPROXY_ALERT_NAME $QPROXY_ALERT_STATUS $QPROXY_ALERT_VALUE\" > "+output+"\n"), 0755))
+
+	alert := &Alert{Name: "queue", Status: alertStatusFiring, Value: 12}
+	newAlerting().send(&alertRule{webhook: webhook.URL, command: []string{command, "ops"}}, alert)
+
+	select {
+	case got := <-received:
+		assert.Equal(t, "queue", got.Name)
+		assert.Equal(t, float64(12), got.Value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook not called")
+	}
+
+	assert.Eventually(t, func() bool {
+		content, err := ioutil.ReadFile(output)
+		return err == nil && string(content) == "ops queue firing 12\n"
+	}, 5*time.Second, 10*time.Millisecond)
+}
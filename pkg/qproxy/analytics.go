@@ -0,0 +1,167 @@
+package qproxy
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// queueWaitBuckets are the upper bounds, in seconds, of the queue wait
+// distribution.
+var queueWaitBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+// QueueWaitStatistics stores the time spent in the queue by the sessions
+// admitted from the queue and by the sessions which expired before their
+// admission. WaitDistribution counts admitted sessions by upper bound of
+// their wait.
+type QueueWaitStatistics struct {
+	Admitted             uint64
+	Abandoned            uint64
+	AbandonmentRate      float64
+	AverageWait          string
+	MaxWait              string
+	AverageAbandonedWait string
+	WaitDistribution     map[string]uint64
+}
+
+// queueWaitAnalytics aggregates the queue waits of a lane.
+type queueWaitAnalytics struct {
+	admitted         uint64
+	abandoned        uint64
+	waitSum          time.Duration
+	maxWait          time.Duration
+	abandonedWaitSum time.Duration
+	buckets          []uint64
+}
+
+func newQueueWaitAnalytics() *queueWaitAnalytics {
+	return &queueWaitAnalytics{buckets: make([]uint64, len(queueWaitBuckets)+1)}
+}
+
+func (a *queueWaitAnalytics) observeAdmission(waited time.Duration) {
+	a.admitted++
+	a.waitSum += waited
+	if waited > a.maxWait {
+		a.maxWait = waited
+	}
+
+	bucket := len(queueWaitBuckets)
+	for i, bound := range queueWaitBuckets {
+		if waited.Seconds() <= bound {
+			bucket = i
+			break
+		}
+	}
+	a.buckets[bucket]++
+}
+
+func (a *queueWaitAnalytics) observeAbandonment(waited time.Duration) {
+	a.abandoned++
+	a.abandonedWaitSum += waited
+}
+
+// merge adds the waits of other to the analytics.
+func (a *queueWaitAnalytics) merge(other *queueWaitAnalytics) {
+	a.admitted += other.admitted
+	a.abandoned += other.abandoned
+	a.waitSum += other.waitSum
+	a.abandonedWaitSum += other.abandonedWaitSum
+	if other.maxWait > a.maxWait {
+		a.maxWait = other.maxWait
+	}
+
+	for i, count := range other.buckets {
+		a.buckets[i] += count
+	}
+}
+
+func (a *queueWaitAnalytics) statistics() *QueueWaitStatistics {
+	statistics := QueueWaitStatistics{
+		Admitted:             a.admitted,
+		Abandoned:            a.abandoned,
+		AverageWait:          time.Duration(0).String(),
+		MaxWait:              a.maxWait.String(),
+		AverageAbandonedWait: time.Duration(0).String(),
+		WaitDistribution:     make(map[string]uint64),
+	}
+
+	if a.admitted > 0 {
+		statistics.AverageWait = (a.waitSum / time.Duration(a.admitted)).String()
+	}
+
+	if a.abandoned > 0 {
+		statistics.AverageAbandonedWait = (a.abandonedWaitSum / time.Duration(a.abandoned)).String()
+		statistics.AbandonmentRate = float64(a.abandoned) / float64(a.admitted+a.abandoned)
+	}
+
+	for i, bound := range queueWaitBuckets {
+		statistics.WaitDistribution[(time.Duration(bound) * time.Second).String()] = a.buckets[i]
+	}
+	statistics.WaitDistribution["+Inf"] = a.buckets[len(queueWaitBuckets)]
+
+	return &statistics
+}
+
+// queueWaitLanes holds the queue wait analytics of a pool by lane.
+type queueWaitLanes map[string]*queueWaitAnalytics
+
+func (lanes queueWaitLanes) lane(lane string) *queueWaitAnalytics {
+	analytics, ok := lanes[lane]
+	if !ok {
+		analytics = newQueueWaitAnalytics()
+		lanes[lane] = analytics
+	}
+
+	return analytics
+}
+
+func (lanes queueWaitLanes) statistics() map[string]*QueueWaitStatistics {
+	statistics := make(map[string]*QueueWaitStatistics)
+	for lane, analytics := range lanes {
+		statistics[lane] = analytics.statistics()
+	}
+
+	return statistics
+}
+
+// total merges the analytics of all lanes.
+func (lanes queueWaitLanes) total() *queueWaitAnalytics {
+	total := newQueueWaitAnalytics()
+	for _, analytics := range lanes {
+		total.merge(analytics)
+	}
+
+	return total
+}
+
+// syncQueueWaitTotal returns the queue wait analytics of all lanes of the pool.
+func (p *pool) syncQueueWaitTotal() *queueWaitAnalytics {
+	p.sessionsLock.RLock()
+	defer p.sessionsLock.RUnlock()
+
+	return p.queueWaits.total()
+}
+
+// observeAdmission records the wait of a session promoted from the queue.
+func (p *pool) observeAdmission(s *session, waited time.Duration) {
+	p.queueWaits.lane(s.lane).observeAdmission(waited)
+	p.metrics.queueWait.WithLabelValues(s.lane).Observe(waited.Seconds())
+}
+
+// observeAbandonment records a queued session which expired before its
+// admission, and emits the `queued_session_expired` event. The session waited
+// until it was last seen.
+func (p *pool) observeAbandonment(s *session) {
+	waited := s.lastSeenAt().Sub(s.created)
+	p.queueWaits.lane(s.lane).observeAbandonment(waited)
+	p.metrics.abandonments.WithLabelValues(s.lane).Inc()
+	p.events.emitExpired(s, nil, "queued", waited)
+
+	sessionsLog.WithFields(log.Fields{
+		"event":   "queued_session_expired",
+		"pool":    p.name,
+		"session": s.id,
+		"lane":    s.lane,
+		"waited":  waited.String(),
+	}).Debug("Queued session expired before admission")
+}
@@ -0,0 +1,106 @@
+package qproxy
+
+import (
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueWaitAnalytics(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	pool := qp.defaultRoom().defaultPool()
+
+	admitted, _, ok := pool.syncNewSession("", nil, defaultLaneName, false)
+	require.True(t, ok)
+	assert.False(t, admitted.admittedAt().IsZero())
+
+	promoted, _, ok := pool.syncNewSession("", nil, defaultLaneName, false)
+	require.True(t, ok)
+	abandoned, _, ok := pool.syncNewSession("", nil, defaultLaneName, false)
+	require.True(t, ok)
+	assert.True(t, promoted.admittedAt().IsZero())
+
+	abandoned.update(-time.Second)
+	pool.syncRemoveSession(admitted.id)
+	pool.syncUpdateSessions()
+
+	assert.False(t, promoted.admittedAt().IsZero())
+	_, _, ok = pool.syncLoadSession(abandoned.id)
+	assert.False(t, ok)
+
+	statistics := qp.syncStatistics()
+	lane := statistics.QueueWaitLanes[defaultLaneName]
+	require.NotNil(t, lane)
+	assert.Equal(t, uint64(1), lane.Admitted)
+	assert.Equal(t, uint64(1), lane.Abandoned)
+	assert.Equal(t, 0.5, lane.AbandonmentRate)
+	assert.Equal(t, uint64(1), lane.WaitDistribution["1s"])
+	assert.Equal(t, lane, statistics.QueueWait)
+
+	rw := httptest.NewRecorder()
+	newAPIHandler(qp).ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	body := rw.Body.String()
+	assert.Contains(t, body, `qproxy_queue_abandonments_total{lane="default",pool="default",room="default"} 1`)
+	assert.Contains(t, body, `qproxy_queue_wait_seconds_count{lane="default",pool="default",room="default"} 1`)
+}
+
+func TestQueueWaitAbandonmentAfterReload(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	pool := qp.defaultRoom().defaultPool()
+
+	_, _, ok := pool.syncNewSession("", nil, defaultLaneName, false)
+	require.True(t, ok)
+	abandoned, _, ok := pool.syncNewSession("", nil, defaultLaneName, false)
+	require.True(t, ok)
+
+	now := time.Now()
+	abandoned.created = now.Add(-10 * time.Second)
+	abandoned.update(-time.Second)
+	atomic.StoreInt64(&abandoned.lastSeen, now.Add(-4*time.Second).UnixNano())
+
+	v.Set("queue.session_ttl", 60)
+	require.NoError(t, qp.config.loadDynamicConfig())
+	require.NoError(t, qp.loadRooms())
+	pool.syncUpdateSessions()
+
+	lane := qp.syncStatistics().QueueWaitLanes[defaultLaneName]
+	require.NotNil(t, lane)
+	assert.Equal(t, uint64(1), lane.Abandoned)
+	assert.Equal(t, (6 * time.Second).String(), lane.AverageAbandonedWait)
+}
+
+func TestQueueWaitAnalyticsMerge(t *testing.T) {
+	a := newQueueWaitAnalytics()
+	a.observeAdmission(2 * time.Second)
+	a.observeAbandonment(time.Minute)
+
+	b := newQueueWaitAnalytics()
+	b.observeAdmission(2 * time.Hour)
+	b.observeAdmission(4 * time.Second)
+	a.merge(b)
+
+	statistics := a.statistics()
+	assert.Equal(t, uint64(3), statistics.Admitted)
+	assert.Equal(t, 0.25, statistics.AbandonmentRate)
+	assert.Equal(t, "40m2s", statistics.AverageWait)
+	assert.Equal(t, "2h0m0s", statistics.MaxWait)
+	assert.Equal(t, "1m0s", statistics.AverageAbandonedWait)
+	assert.Equal(t, uint64(2), statistics.WaitDistribution["5s"])
+	assert.Equal(t, uint64(1), statistics.WaitDistribution["+Inf"])
+}
@@ -3,6 +3,7 @@ package qproxy
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
 )
 
 type apiHandler struct {
@@ -13,12 +14,22 @@ type apiHandler struct {
 func newAPIHandler(qp *QProxy) *apiHandler {
 	router := http.NewServeMux()
 	router.Handle("/statistics", newAPIStatisticsHandler(qp))
+	router.Handle("/statistics/history", qp.history)
+	router.HandleFunc("/statistics/reset", func(rw http.ResponseWriter, r *http.Request) {
+		resetTraffic(rw, r, qp.resetTraffic)
+	})
 	router.HandleFunc("/template/full", func(rw http.ResponseWriter, r *http.Request) {
-		qp.config.getTemplate("queue.full_template").Execute(rw, nil)
+		qp.defaultRoom().defaultPool().config().fullTemplate.Execute(rw, nil)
 	})
 	router.HandleFunc("/template/queue", func(rw http.ResponseWriter, r *http.Request) {
-		qp.config.getTemplate("queue.template").Execute(rw, nil)
+		qp.defaultRoom().defaultPool().config().template.Execute(rw, nil)
+	})
+	router.HandleFunc("/invitations", func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, qp.defaultRoom().syncInvitationStatistics())
 	})
+	router.Handle("/rooms/", newAPIRoomHandler(qp))
+	router.Handle("/metrics", qp.metrics.handler())
+	router.Handle("/events", qp.events)
 
 	return &apiHandler{qp: qp, router: router}
 }
@@ -50,8 +61,63 @@ func newAPIStatisticsHandler(qp *QProxy) *apiStatisticsHandler {
 }
 
 func (handler *apiStatisticsHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	statistics := handler.qp.syncStatistics()
-	js, err := json.Marshal(statistics)
+	writeJSON(rw, handler.qp.syncStatistics())
+}
+
+// apiRoomHandler serves the `/rooms/{name}/statistics`,
+// `/rooms/{name}/statistics/reset`, `/rooms/{name}/invitations` and `/rooms/{name}/template/{full,queue}`
+// endpoints.
+type apiRoomHandler struct {
+	qp *QProxy
+}
+
+func newAPIRoomHandler(qp *QProxy) *apiRoomHandler {
+	return &apiRoomHandler{qp: qp}
+}
+
+func (handler *apiRoomHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/rooms/"), "/", 2)
+	if len(parts) != 2 {
+		http.NotFound(rw, r)
+		return
+	}
+
+	room, ok := handler.qp.room(parts[0])
+	if !ok {
+		http.NotFound(rw, r)
+		return
+	}
+
+	switch parts[1] {
+	case "statistics":
+		writeJSON(rw, room.syncStatistics())
+	case "statistics/reset":
+		resetTraffic(rw, r, room.resetTraffic)
+	case "invitations":
+		writeJSON(rw, room.syncInvitationStatistics())
+	case "template/full":
+		room.defaultPool().config().fullTemplate.Execute(rw, nil)
+	case "template/queue":
+		room.defaultPool().config().template.Execute(rw, nil)
+	default:
+		http.NotFound(rw, r)
+	}
+}
+
+// resetTraffic calls reset on POST requests only.
+func resetTraffic(rw http.ResponseWriter, r *http.Request, reset func()) {
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reset()
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(rw http.ResponseWriter, value interface{}) {
+	js, err := json.Marshal(value)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
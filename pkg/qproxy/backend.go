@@ -2,10 +2,15 @@ package qproxy
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,6 +21,30 @@ type BackendStatistics struct {
 	Sessions    int
 	MaxSessions int
 	SessionTTL  string
+
+	WhitelistedSessions int
+	WhitelistedRequests uint64
+	BypassedRequests    uint64
+
+	InFlightRequests    int
+	WaitingRequests     int
+	MaxInFlightRequests int
+
+	ReservedSessions    int
+	MaxReservedSessions int
+
+	Traffic BackendTrafficStatistics
+}
+
+// backendCounters stores counters which survive configuration reloads
+type backendCounters struct {
+	whitelistedRequests uint64
+	bypassedRequests    uint64
+	traffic             *backendTraffic
+}
+
+func newBackendCounters() *backendCounters {
+	return &backendCounters{traffic: newBackendTraffic()}
 }
 
 type backend struct {
@@ -25,30 +54,64 @@ type backend struct {
 	sessionTTL   time.Duration
 	maxSessions  int
 	handler      *httputil.ReverseProxy
+	transport    *http.Transport
 	sessionStore *sessionStore
+	counters     *backendCounters
+
+	// Places reserved for invitation code holders are taken from maxSessions
+	reservedSessions int
+	reservedStore    *sessionStore
+	limiter          *requestLimiter
+	requests         requestsConfig
 }
 
-func newBackend(name string, config *backendConfig, store *sessionStore) (*backend, error) {
+// newBackend creates a backend, sessions and counters of the previous backend
+// with the same name are kept when one is given.
+func newBackend(name string, config *backendConfig, previous *backend) (*backend, error) {
 	proxyURL, err := url.Parse(config.url)
 	if err != nil {
 		return nil, err
 	}
 
-	if store == nil {
-		store = newSessionStore()
+	store := newSessionStore()
+	reservedStore := newSessionStore()
+	counters := newBackendCounters()
+	limiter := newRequestLimiter()
+	if previous != nil {
+		store = previous.sessionStore
+		reservedStore = previous.reservedStore
+		counters = previous.counters
+		limiter = previous.limiter
 	}
+	limiter.setLimits(config.requests.maxInFlight, config.requests.queueSize)
 
 	handler := httputil.NewSingleHostReverseProxy(proxyURL)
-	handler.Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: config.tlsInsecure},
+	handler.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, err error) {
+		counters.traffic.countUpstreamError()
+		handleBackendError(rw, r, err)
+	}
+	tlsConfig, err := newBackendTLSConfig(&config.tls)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
 		DialContext: (&net.Dialer{
-			Timeout: 5 * time.Second,
+			Timeout: config.transport.dialTimeout,
 		}).DialContext,
-		TLSHandshakeTimeout: 5 * time.Second,
-		ForceAttemptHTTP2:   true,
-		MaxIdleConnsPerHost: config.maxSessions,
-		IdleConnTimeout:     300 * time.Second,
+		TLSHandshakeTimeout:   config.transport.tlsHandshakeTimeout,
+		ResponseHeaderTimeout: config.transport.responseHeaderTimeout,
+		ForceAttemptHTTP2:     config.transport.http2,
+		MaxConnsPerHost:       config.transport.maxConnsPerHost,
+		MaxIdleConnsPerHost:   config.transport.maxIdleConnsPerHost,
+		IdleConnTimeout:       config.transport.idleConnTimeout,
+		DisableKeepAlives:     !config.transport.keepAlive,
+	}
+	if !config.transport.http2 {
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
 	}
+	handler.Transport = transport
 
 	return &backend{
 		name:         name,
@@ -57,16 +120,106 @@ func newBackend(name string, config *backendConfig, store *sessionStore) (*backe
 		sessionTTL:   config.sessionTTL,
 		maxSessions:  config.maxSessions,
 		handler:      handler,
+		transport:    transport,
 		sessionStore: store,
+		counters:     counters,
+		limiter:      limiter,
+		requests:     config.requests,
+
+		reservedSessions: config.reservedSessions,
+		reservedStore:    reservedStore,
 	}, nil
 }
 
-func (b *backend) removeExpiredSessions() {
-	b.sessionStore.removeExpired()
+// ServeHTTP proxies the request to the backend once an in-flight request slot
+// is available.
+func (b *backend) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !b.limiter.acquire(r.Context(), b.requests.queueTimeout) {
+		http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer b.limiter.release()
+
+	b.counters.traffic.serveObserved(rw, r, b.handler)
+}
+
+// newBackendTLSConfig builds the TLS configuration used to connect to a
+// backend, certificate files are read each time the backend is created so
+// they are reloaded with the configuration.
+func newBackendTLSConfig(config *backendTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.insecure,
+		ServerName:         config.serverName,
+	}
+
+	if config.caFile != "" {
+		pem, err := ioutil.ReadFile(config.caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificate found in " + config.caFile)
+		}
+	}
+
+	if config.certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.certFile, config.keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// balance returns the given backends in the order they should be tried for a
+// new assignment: backends are shuffled and those whose weight is greater
+// than a random draw come first.
+func balance(backends []*backend) []*backend {
+	shuffled := make([]*backend, len(backends))
+	copy(shuffled, backends)
+	rand.Shuffle(len(shuffled), func(i int, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	rndWeight := rand.Float64()
+	ordered := make([]*backend, 0, len(shuffled))
+	for _, backend := range shuffled {
+		if backend.weight >= rndWeight {
+			ordered = append(ordered, backend)
+		}
+	}
+	for _, backend := range shuffled {
+		if backend.weight < rndWeight {
+			ordered = append(ordered, backend)
+		}
+	}
+
+	return ordered
+}
+
+func (b *backend) removeExpiredSessions() []*session {
+	expired := append(b.sessionStore.removeExpired(), b.reservedStore.removeExpired()...)
+	b.counters.traffic.countExpirations(len(expired))
+
+	return expired
 }
 
 func (b *backend) remainingPlaces() int {
-	remainingPlaces := b.maxSessions - b.sessionStore.len()
+	remainingPlaces := b.maxSessions - b.reservedSessions - b.sessionStore.len()
+	if remainingPlaces < 0 {
+		return 0
+	}
+
+	return remainingPlaces
+}
+
+func (b *backend) remainingReservedPlaces() int {
+	remainingPlaces := b.reservedSessions - b.reservedStore.len()
 	if remainingPlaces < 0 {
 		return 0
 	}
@@ -75,11 +228,27 @@ func (b *backend) remainingPlaces() int {
 }
 
 func (b *backend) loadSession(id string) (*session, bool) {
-	return b.sessionStore.load(id)
+	if s, ok := b.sessionStore.load(id); ok {
+		return s, true
+	}
+
+	return b.reservedStore.load(id)
+}
+
+func (b *backend) removeSession(id string) bool {
+	return b.sessionStore.remove(id) || b.reservedStore.remove(id)
+}
+
+func (b *backend) storeReservedSession(id string) (*session, bool) {
+	if b.remainingReservedPlaces() == 0 {
+		return nil, false
+	}
+
+	return b.reservedStore.store(newSession(id, b.sessionTTL)), true
 }
 
 func (b *backend) storeSession(id string) (*session, bool) {
-	if s, ok := b.sessionStore.load(id); ok {
+	if s, ok := b.loadSession(id); ok {
 		return s, true
 	}
 
@@ -90,12 +259,58 @@ func (b *backend) storeSession(id string) (*session, bool) {
 	return b.sessionStore.store(newSession(id, b.sessionTTL)), true
 }
 
+// adoptSession moves an existing session to the backend.
+func (b *backend) adoptSession(s *session) bool {
+	if b.remainingPlaces() == 0 {
+		return false
+	}
+
+	s.update(b.sessionTTL)
+	b.sessionStore.store(s)
+
+	return true
+}
+
+func (b *backend) storeWhitelistedSession(id string) (*session, bool) {
+	if b.remainingPlaces() == 0 {
+		return nil, false
+	}
+
+	s := newSession(id, b.sessionTTL)
+	s.whitelisted = true
+
+	return b.sessionStore.store(s), true
+}
+
+func (b *backend) countWhitelistedRequest() {
+	atomic.AddUint64(&b.counters.whitelistedRequests, 1)
+}
+
+func (b *backend) countBypassedRequest() {
+	atomic.AddUint64(&b.counters.bypassedRequests, 1)
+}
+
 func (b *backend) statistics() *BackendStatistics {
+	inFlight, waiting := b.limiter.counts()
+
 	return &BackendStatistics{
 		Name:        b.name,
 		URL:         b.url.String(),
 		SessionTTL:  b.sessionTTL.String(),
 		Sessions:    b.sessionStore.len(),
 		MaxSessions: b.maxSessions,
+
+		WhitelistedSessions: b.sessionStore.countWhitelisted(),
+		WhitelistedRequests: atomic.LoadUint64(&b.counters.whitelistedRequests),
+		BypassedRequests:    atomic.LoadUint64(&b.counters.bypassedRequests),
+
+		InFlightRequests:    inFlight,
+		WaitingRequests:     waiting,
+		MaxInFlightRequests: b.requests.maxInFlight,
+
+		ReservedSessions:    b.reservedStore.len(),
+		MaxReservedSessions: b.reservedSessions,
+
+		Traffic: b.counters.traffic.statistics(),
 	}
 }
@@ -0,0 +1,32 @@
+package qproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBalance(t *testing.T) {
+	light := &backend{name: "light", weight: 0}
+	heavy := &backend{name: "heavy", weight: 1}
+
+	for i := 0; i < 10; i++ {
+		backends := balance([]*backend{light, heavy})
+		assert.Equal(t, []*backend{heavy, light}, backends)
+	}
+
+	assert.Empty(t, balance([]*backend{}))
+}
+
+func TestBackendTLSConfig(t *testing.T) {
+	tlsConfig, err := newBackendTLSConfig(&backendTLSConfig{insecure: true, serverName: "backend.local"})
+	assert.NoError(t, err)
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+	assert.Equal(t, "backend.local", tlsConfig.ServerName)
+
+	_, err = newBackendTLSConfig(&backendTLSConfig{caFile: "../../test/template.html"})
+	assert.EqualError(t, err, "No certificate found in ../../test/template.html")
+
+	_, err = newBackendTLSConfig(&backendTLSConfig{certFile: "missing.pem", keyFile: "missing.pem"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,153 @@
+package qproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	bindingActionInvalidate = "invalidate"
+	bindingActionRequeue    = "requeue"
+)
+
+// bindingConfig describes how sessions are bound to the client which created
+// them, to prevent session cookies from being shared.
+type bindingConfig struct {
+	ipv4Prefix int
+	ipv6Prefix int
+	userAgent  bool
+	maxIPs     int
+	action     string
+}
+
+func newBindingConfig(v *viper.Viper) *bindingConfig {
+	v.SetDefault("binding.action", bindingActionInvalidate)
+
+	return &bindingConfig{
+		ipv4Prefix: v.GetInt("binding.ipv4_prefix"),
+		ipv6Prefix: v.GetInt("binding.ipv6_prefix"),
+		userAgent:  v.GetBool("binding.user_agent"),
+		maxIPs:     v.GetInt("binding.max_ips"),
+		action:     v.GetString("binding.action"),
+	}
+}
+
+func validateBindingConfig(v *viper.Viper) error {
+	if prefix := v.GetInt("binding.ipv4_prefix"); prefix < 0 || prefix > 32 {
+		return errors.New("Option `binding.ipv4_prefix` must be between 0 and 32")
+	}
+
+	if prefix := v.GetInt("binding.ipv6_prefix"); prefix < 0 || prefix > 128 {
+		return errors.New("Option `binding.ipv6_prefix` must be between 0 and 128")
+	}
+
+	if v.GetInt("binding.max_ips") < 0 {
+		return errors.New("Option `binding.max_ips` must be greater or equals than 0")
+	}
+
+	action := v.GetString("binding.action")
+	if action != "" && action != bindingActionInvalidate && action != bindingActionRequeue {
+		return errors.New("Option `binding.action` must be `invalidate` or `requeue`")
+	}
+
+	return nil
+}
+
+func (config *bindingConfig) enabled() bool {
+	return config.ipv4Prefix > 0 || config.ipv6Prefix > 0 || config.userAgent || config.maxIPs > 0
+}
+
+// network returns the network of the client IP, or an empty string when the
+// IP family is not bound.
+func (config *bindingConfig) network(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return ""
+	}
+
+	prefix := config.ipv6Prefix
+	if ip.To4() != nil {
+		prefix = config.ipv4Prefix
+	}
+	if prefix == 0 {
+		return ""
+	}
+
+	return maskIP(ip, config.ipv4Prefix, config.ipv6Prefix).String()
+}
+
+// maskIP returns the network of the IP, using the prefix length of its family.
+func maskIP(ip net.IP, ipv4Prefix int, ipv6Prefix int) net.IP {
+	if ip.To4() != nil {
+		return ip.Mask(net.CIDRMask(ipv4Prefix, 32))
+	}
+
+	return ip.Mask(net.CIDRMask(ipv6Prefix, 128))
+}
+
+func (config *bindingConfig) userAgentHash(userAgent string) string {
+	if !config.userAgent {
+		return ""
+	}
+
+	hash := sha256.Sum256([]byte(userAgent))
+
+	return hex.EncodeToString(hash[:16])
+}
+
+// newSessionBinding records the fingerprint of the client creating a session.
+func (config *bindingConfig) newSessionBinding(clientIP string, userAgent string) *sessionBinding {
+	if !config.enabled() {
+		return nil
+	}
+
+	return &sessionBinding{
+		config:    config,
+		network:   config.network(clientIP),
+		userAgent: config.userAgentHash(userAgent),
+		ips:       map[string]bool{clientIP: true},
+	}
+}
+
+// sessionBinding is the fingerprint of the client owning a session, along
+// with the configuration it was computed with.
+type sessionBinding struct {
+	lock      sync.Mutex
+	config    *bindingConfig
+	network   string
+	userAgent string
+	ips       map[string]bool
+}
+
+// matches checks the client using the session against the fingerprint, new
+// IPs are recorded until the maximum number of distinct IPs is reached. The
+// fingerprint of the client is computed with the prefixes and user agent mode
+// of the session, so that a reload does not invalidate live sessions.
+func (b *sessionBinding) matches(config *bindingConfig, clientIP string, userAgent string) bool {
+	if b == nil {
+		return true
+	}
+
+	if b.network != b.config.network(clientIP) || b.userAgent != b.config.userAgentHash(userAgent) {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.ips[clientIP] || config.maxIPs <= 0 {
+		return true
+	}
+
+	if len(b.ips) >= config.maxIPs {
+		return false
+	}
+	b.ips[clientIP] = true
+
+	return true
+}
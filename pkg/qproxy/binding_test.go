@@ -0,0 +1,191 @@
+package qproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionBinding(t *testing.T) {
+	config := &bindingConfig{ipv4Prefix: 24, ipv6Prefix: 64, userAgent: true, maxIPs: 2}
+	binding := config.newSessionBinding("192.0.2.1", "firefox")
+
+	assert.True(t, binding.matches(config, "192.0.2.1", "firefox"))
+	assert.True(t, binding.matches(config, "192.0.2.2", "firefox"))
+	assert.False(t, binding.matches(config, "192.0.2.3", "firefox"))
+	assert.False(t, binding.matches(config, "192.0.2.1", "chrome"))
+	assert.False(t, binding.matches(config, "198.51.100.1", "firefox"))
+	assert.False(t, binding.matches(config, "2001:db8::1", "firefox"))
+
+	reloaded := &bindingConfig{ipv4Prefix: 16, ipv6Prefix: 48, maxIPs: 3}
+	assert.True(t, binding.matches(reloaded, "192.0.2.3", "firefox"))
+	assert.False(t, binding.matches(reloaded, "192.0.3.1", "firefox"))
+	assert.False(t, binding.matches(reloaded, "192.0.2.4", "chrome"))
+
+	var unbound *sessionBinding
+	assert.True(t, unbound.matches(config, "198.51.100.1", "chrome"))
+	assert.Nil(t, (&bindingConfig{}).newSessionBinding("192.0.2.1", "firefox"))
+}
+
+func TestSessionBindingPromotion(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("quotas.max_sessions_per_ip", 2)
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	pool := qp.defaultRoom().defaultPool()
+
+	admitted, _, ok := pool.syncNewSession("192.0.2.1", nil, defaultLaneName, false)
+	require.True(t, ok)
+	binding := (&bindingConfig{userAgent: true}).newSessionBinding("192.0.2.2", "firefox")
+	queued, backend, ok := pool.syncNewSession("192.0.2.2", binding, defaultLaneName, false)
+	require.True(t, ok)
+	require.Nil(t, backend)
+	assert.Equal(t, binding, queued.binding)
+
+	pool.syncRemoveSession(admitted.id)
+	pool.syncUpdateSessions()
+
+	promoted, backend, ok := pool.syncLoadSession(queued.id)
+	require.True(t, ok)
+	require.NotNil(t, backend)
+	assert.Equal(t, binding, promoted.binding)
+	assert.Equal(t, &clientCounts{admitted: 1}, pool.clients["192.0.2.2"])
+}
+
+func TestSessionBindingActions(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("binding.user_agent", true)
+	v.Set("binding.action", "requeue")
+	require.NoError(t, ValidateProxyConfig(v))
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	handler := newProxyHandler(qp)
+	pool := qp.defaultRoom().defaultPool()
+
+	_, _, ok := pool.syncNewSession("", nil, defaultLaneName, false)
+	require.True(t, ok)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "firefox")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	cookies := rw.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "chrome")
+	r.AddCookie(cookies[0])
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	require.Len(t, rw.Result().Cookies(), 1)
+	assert.NotEqual(t, cookies[0].Value, rw.Result().Cookies()[0].Value)
+
+	_, _, ok = pool.syncLoadSession(cookies[0].Value)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), qp.defaultRoom().syncStatistics().BindingMismatches)
+
+	v.Set("binding.action", "invalidate")
+	require.NoError(t, qp.config.loadDynamicConfig())
+	require.NoError(t, qp.loadRooms())
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	_, _, ok = pool.syncLoadSession(cookies[0].Value)
+	assert.False(t, ok)
+
+	v.Set("binding.action", "other")
+	assert.EqualError(t, ValidateProxyConfig(v), "Option `binding.action` must be `invalidate` or `requeue`")
+}
+
+func TestSessionBindingReload(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("binding.ipv4_prefix", 24)
+	v.Set("binding.user_agent", true)
+	require.NoError(t, ValidateProxyConfig(v))
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	handler := newProxyHandler(qp)
+	pool := qp.defaultRoom().defaultPool()
+
+	_, _, ok := pool.syncNewSession("", nil, defaultLaneName, false)
+	require.True(t, ok)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("User-Agent", "firefox")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	cookies := rw.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	v.Set("binding.ipv4_prefix", 32)
+	v.Set("binding.user_agent", false)
+	require.NoError(t, qp.config.loadDynamicConfig())
+	require.NoError(t, qp.loadRooms())
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.2:1234"
+	r.Header.Set("User-Agent", "firefox")
+	r.AddCookie(cookies[0])
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	assert.Empty(t, rw.Result().Cookies())
+	assert.Equal(t, uint64(0), qp.defaultRoom().syncStatistics().BindingMismatches)
+
+	r.Header.Set("User-Agent", "chrome")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, uint64(1), qp.defaultRoom().syncStatistics().BindingMismatches)
+	_, _, ok = pool.syncLoadSession(cookies[0].Value)
+	assert.False(t, ok)
+}
+
+func TestSessionBindingBypass(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 2)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("binding.user_agent", true)
+	v.Set("binding.action", "requeue")
+	v.Set("gate.rules", []map[string]interface{}{{"paths": []string{"/static/*"}, "action": "bypass"}})
+	require.NoError(t, ValidateProxyConfig(v))
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	handler := newProxyHandler(qp)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "firefox")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	cookies := rw.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	r = httptest.NewRequest("GET", "/static/app.js", nil)
+	r.Header.Set("User-Agent", "chrome")
+	r.AddCookie(cookies[0])
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, uint64(1), qp.defaultRoom().syncStatistics().BindingMismatches)
+
+	v.Set("whitelisted_ips", []string{"192.0.2.1"})
+	v.Set("whitelist.consume_capacity", true)
+	require.NoError(t, qp.config.loadDynamicConfig())
+	require.NoError(t, qp.loadRooms())
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "chrome")
+	r.AddCookie(cookies[0])
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	require.Len(t, rw.Result().Cookies(), 1)
+	assert.NotEqual(t, cookies[0].Value, rw.Result().Cookies()[0].Value)
+	assert.Equal(t, uint64(2), qp.defaultRoom().syncStatistics().BindingMismatches)
+}
@@ -0,0 +1,330 @@
+package qproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"html/template"
+	"math"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/spf13/viper"
+)
+
+const maxChallengeDifficulty = 32
+
+// challengeScriptTemplate solves the challenge in the browser: it looks for a
+// counter such as SHA-256(nonce:counter) starts with difficulty zero bits,
+// stores the solution in a cookie and reloads the page.
+var challengeScriptTemplate = template.Must(template.New("challenge_script").Parse(`<script>
+(function() {
+	var nonce = {{.Nonce}}, difficulty = {{.Difficulty}}, cookieName = {{.CookieName}}, maxAge = {{.MaxAge}};
+	var K = [
+		0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+		0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+		0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+		0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+		0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+		0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+		0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+		0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+	];
+
+	function rotate(x, n) {
+		return (x >>> n) | (x << (32 - n));
+	}
+
+	function sha256(message) {
+		var H = [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19];
+		var bytes = [], w = new Array(64), i, j;
+		for (i = 0; i < message.length; i++) {
+			bytes.push(message.charCodeAt(i) & 0xff);
+		}
+		var length = bytes.length * 8;
+		bytes.push(0x80);
+		while (bytes.length % 64 !== 56) {
+			bytes.push(0);
+		}
+		for (i = 7; i >= 0; i--) {
+			bytes.push(i > 3 ? 0 : (length >>> (i * 8)) & 0xff);
+		}
+
+		for (j = 0; j < bytes.length; j += 64) {
+			for (i = 0; i < 16; i++) {
+				w[i] = (bytes[j + 4 * i] << 24) | (bytes[j + 4 * i + 1] << 16) | (bytes[j + 4 * i + 2] << 8) | bytes[j + 4 * i + 3];
+			}
+			for (i = 16; i < 64; i++) {
+				var s0 = rotate(w[i - 15], 7) ^ rotate(w[i - 15], 18) ^ (w[i - 15] >>> 3);
+				var s1 = rotate(w[i - 2], 17) ^ rotate(w[i - 2], 19) ^ (w[i - 2] >>> 10);
+				w[i] = (w[i - 16] + s0 + w[i - 7] + s1) | 0;
+			}
+
+			var h = H.slice();
+			for (i = 0; i < 64; i++) {
+				var S1 = rotate(h[4], 6) ^ rotate(h[4], 11) ^ rotate(h[4], 25);
+				var t1 = (h[7] + S1 + ((h[4] & h[5]) ^ (~h[4] & h[6])) + K[i] + w[i]) | 0;
+				var S0 = rotate(h[0], 2) ^ rotate(h[0], 13) ^ rotate(h[0], 22);
+				var t2 = (S0 + ((h[0] & h[1]) ^ (h[0] & h[2]) ^ (h[1] & h[2]))) | 0;
+				h = [(t1 + t2) | 0, h[0], h[1], h[2], (h[3] + t1) | 0, h[4], h[5], h[6]];
+			}
+			for (i = 0; i < 8; i++) {
+				H[i] = (H[i] + h[i]) | 0;
+			}
+		}
+
+		return H;
+	}
+
+	function leadingZeros(H) {
+		var count = 0;
+		for (var i = 0; i < H.length; i++) {
+			if (H[i] !== 0) {
+				return count + Math.clz32(H[i]);
+			}
+			count += 32;
+		}
+		return count;
+	}
+
+	var counter = 0;
+	function solve() {
+		for (var end = counter + 10000; counter < end; counter++) {
+			if (leadingZeros(sha256(nonce + ":" + counter)) >= difficulty) {
+				document.cookie = cookieName + "=" + nonce + ":" + counter + "; path=/; max-age=" + maxAge;
+				window.location.reload();
+				return;
+			}
+		}
+		setTimeout(solve, 0);
+	}
+	solve();
+})();
+</script>`))
+
+var defaultChallengeTemplate = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Please wait</title></head>
+<body>
+<p>Checking your browser, please wait...</p>
+<noscript>JavaScript is required to join the queue.</noscript>
+{{.Script}}
+</body>
+</html>
+`))
+
+// challengeConfig describes the proof-of-work challenge solved by clients
+// before they join the queue.
+type challengeConfig struct {
+	enabled       bool
+	minDifficulty int
+	maxDifficulty int
+	cookieName    string
+	secret        []byte
+	ttl           time.Duration
+	template      *template.Template
+}
+
+func newChallengeConfig(v *viper.Viper) (*challengeConfig, error) {
+	v.SetDefault("challenge.min_difficulty", 12)
+	v.SetDefault("challenge.max_difficulty", 20)
+	v.SetDefault("challenge.cookie_name", v.GetString("cookie_name")+"_challenge")
+	v.SetDefault("challenge.ttl", 300)
+
+	config := challengeConfig{
+		enabled:       v.GetBool("challenge.enabled"),
+		minDifficulty: v.GetInt("challenge.min_difficulty"),
+		maxDifficulty: v.GetInt("challenge.max_difficulty"),
+		cookieName:    v.GetString("challenge.cookie_name"),
+		secret:        []byte(v.GetString("challenge.secret")),
+		ttl:           v.GetDuration("challenge.ttl") * time.Second,
+		template:      defaultChallengeTemplate,
+	}
+
+	if v.GetString("challenge.template") != "" {
+		challengeTemplate, err := template.ParseFiles(v.GetString("challenge.template"))
+		if err != nil {
+			return nil, err
+		}
+		config.template = challengeTemplate
+	}
+
+	return &config, nil
+}
+
+func validateChallengeConfig(v *viper.Viper) error {
+	if !v.GetBool("challenge.enabled") {
+		return nil
+	}
+
+	if v.GetString("challenge.secret") == "" {
+		return errors.New("Missing `challenge.secret` option")
+	}
+
+	minDifficulty, maxDifficulty := 12, 20
+	if v.IsSet("challenge.min_difficulty") {
+		minDifficulty = v.GetInt("challenge.min_difficulty")
+	}
+	if v.IsSet("challenge.max_difficulty") {
+		maxDifficulty = v.GetInt("challenge.max_difficulty")
+	}
+
+	if minDifficulty < 0 || minDifficulty > maxDifficulty || maxDifficulty > maxChallengeDifficulty {
+		return errors.New("Options `challenge.min_difficulty` and `challenge.max_difficulty` must be ordered between 0 and 32")
+	}
+
+	if v.IsSet("challenge.ttl") && v.GetInt("challenge.ttl") <= 0 {
+		return errors.New("Option `challenge.ttl` must be greater than 0")
+	}
+
+	return nil
+}
+
+// difficulty scales the difficulty with the queue pressure, between 0 and 1.
+func (config *challengeConfig) difficulty(pressure float64) int {
+	pressure = math.Max(0, math.Min(1, pressure))
+
+	return config.minDifficulty + int(math.Round(float64(config.maxDifficulty-config.minDifficulty)*pressure))
+}
+
+// newNonce signs the expiration and the difficulty of a new challenge.
+func (config *challengeConfig) newNonce(difficulty int) string {
+	expires := time.Now().Add(config.ttl).Unix()
+
+	return signValue(config.secret, strconv.FormatInt(expires, 10)+"-"+strconv.Itoa(difficulty)+"-"+xid.New().String())
+}
+
+// verify checks the solution sent in the challenge cookie and returns its
+// nonce with its expiration.
+func (config *challengeConfig) verify(r *http.Request) (string, time.Time, error) {
+	cookie, err := r.Cookie(config.cookieName)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	idx := strings.LastIndex(cookie.Value, ":")
+	if idx < 0 {
+		return "", time.Time{}, errors.New("Malformed challenge solution")
+	}
+	nonce, counter := cookie.Value[:idx], cookie.Value[idx+1:]
+
+	value, ok := verifySignedValue(config.secret, nonce)
+	if !ok {
+		return "", time.Time{}, errors.New("Invalid challenge signature")
+	}
+
+	fields := strings.Split(value, "-")
+	if len(fields) != 3 {
+		return "", time.Time{}, errors.New("Malformed challenge nonce")
+	}
+
+	expires, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if time.Now().Unix() > expires {
+		return "", time.Time{}, errors.New("Expired challenge")
+	}
+
+	difficulty, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	hash := sha256.Sum256([]byte(nonce + ":" + counter))
+	if leadingZeroBits(hash[:]) < difficulty {
+		return "", time.Time{}, errors.New("Invalid challenge solution")
+	}
+
+	return nonce, time.Unix(expires, 0), nil
+}
+
+// serve sends a page solving a new challenge with the given difficulty.
+func (config *challengeConfig) serve(rw http.ResponseWriter, difficulty int) {
+	data := struct {
+		Nonce      string
+		Difficulty int
+		CookieName string
+		MaxAge     int
+		Script     template.HTML
+	}{
+		Nonce:      config.newNonce(difficulty),
+		Difficulty: difficulty,
+		CookieName: config.cookieName,
+		MaxAge:     int(config.ttl / time.Second),
+	}
+
+	var script bytes.Buffer
+	challengeScriptTemplate.Execute(&script, data)
+	data.Script = template.HTML(script.String())
+
+	rw.Header().Set("Cache-Control", "no-store")
+	config.template.Execute(rw, data)
+}
+
+func leadingZeroBits(hash []byte) int {
+	count := 0
+	for _, b := range hash {
+		if b != 0 {
+			return count + bits.LeadingZeros8(b)
+		}
+		count += 8
+	}
+
+	return count
+}
+
+// challengeUsage remembers the solved challenges, and the handshake cookies,
+// until they expire so that each of them allocates a single session.
+type challengeUsage struct {
+	lock   sync.Mutex
+	solved map[string]time.Time
+}
+
+func newChallengeUsage() *challengeUsage {
+	return &challengeUsage{solved: make(map[string]time.Time)}
+}
+
+func (u *challengeUsage) use(nonce string, expires time.Time) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if _, ok := u.solved[nonce]; ok {
+		return false
+	}
+	u.solved[nonce] = expires
+
+	return true
+}
+
+func (u *challengeUsage) used(nonce string) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	_, ok := u.solved[nonce]
+
+	return ok
+}
+
+// release forgets a nonce which could not allocate a session.
+func (u *challengeUsage) release(nonce string) {
+	u.lock.Lock()
+	delete(u.solved, nonce)
+	u.lock.Unlock()
+}
+
+func (u *challengeUsage) removeExpired() {
+	u.lock.Lock()
+	now := time.Now()
+	for nonce, expires := range u.solved {
+		if expires.Before(now) {
+			delete(u.solved, nonce)
+		}
+	}
+	u.lock.Unlock()
+}
@@ -0,0 +1,105 @@
+package qproxy
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func solveChallenge(nonce string, difficulty int) string {
+	for counter := 0; ; counter++ {
+		hash := sha256.Sum256([]byte(nonce + ":" + strconv.Itoa(counter)))
+		if leadingZeroBits(hash[:]) >= difficulty {
+			return strconv.Itoa(counter)
+		}
+	}
+}
+
+func TestChallengeDifficulty(t *testing.T) {
+	config := &challengeConfig{minDifficulty: 10, maxDifficulty: 20}
+	assert.Equal(t, 10, config.difficulty(0))
+	assert.Equal(t, 15, config.difficulty(0.5))
+	assert.Equal(t, 20, config.difficulty(2))
+
+	assert.Equal(t, 0, leadingZeroBits([]byte{0xff}))
+	assert.Equal(t, 12, leadingZeroBits([]byte{0x00, 0x08}))
+}
+
+func TestChallenge(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("queue.max_sessions", 3)
+	v.Set("challenge.enabled", true)
+	assert.EqualError(t, ValidateProxyConfig(v), "Missing `challenge.secret` option")
+
+	v.Set("challenge.secret", "secret")
+	v.Set("challenge.min_difficulty", 4)
+	v.Set("challenge.max_difficulty", 8)
+	require.NoError(t, ValidateProxyConfig(v))
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	handler := newProxyHandler(qp)
+	for i := 0; i < 2; i++ {
+		_, _, ok := qp.defaultRoom().defaultPool().syncNewSession("", nil, defaultLaneName, false)
+		require.True(t, ok)
+	}
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	matches := regexp.MustCompile(`nonce = "([^"]+)", difficulty =\s*(\d+)`).FindStringSubmatch(rw.Body.String())
+	require.Len(t, matches, 3)
+	assert.Equal(t, "5", matches[2])
+
+	nonce := matches[1]
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "qpid_challenge", Value: nonce + ":" + solveChallenge(nonce, 5)})
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.NotContains(t, rw.Body.String(), "nonce")
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	assert.Contains(t, rw.Body.String(), "nonce")
+
+	statistics := qp.defaultRoom().syncStatistics()
+	assert.Equal(t, 2, statistics.QueuedSessions)
+	assert.Equal(t, uint64(2), statistics.ChallengesIssued)
+	assert.Equal(t, uint64(1), statistics.ChallengesSolved)
+	assert.Equal(t, uint64(1), statistics.ChallengesRejected)
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	matches = regexp.MustCompile(`nonce = "([^"]+)", difficulty =\s*(\d+)`).FindStringSubmatch(rw.Body.String())
+	require.Len(t, matches, 3)
+	pool := qp.defaultRoom().defaultPool()
+	for pool.syncHasRemainingQueueSlots() {
+		_, _, ok := pool.syncNewSession("", nil, defaultLaneName, false)
+		require.True(t, ok)
+	}
+
+	nonce = matches[1]
+	difficulty, err := strconv.Atoi(matches[2])
+	require.NoError(t, err)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "qpid_challenge", Value: nonce + ":" + solveChallenge(nonce, difficulty)})
+	_, _, err = qp.defaultRoom().config().challenge.verify(r)
+	require.NoError(t, err)
+	_, _, ok := qp.defaultRoom().newSession(r, pool, "", nil, defaultLaneName, false)
+	assert.False(t, ok)
+	assert.False(t, qp.defaultRoom().challengeUsage.used(nonce))
+	assert.Equal(t, uint64(1), qp.defaultRoom().syncStatistics().ChallengesSolved)
+
+	v.Set("challenge.max_difficulty", 40)
+	assert.EqualError(t, ValidateProxyConfig(v), "Options `challenge.min_difficulty` and `challenge.max_difficulty` must be ordered between 0 and 32")
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"net/http"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -17,10 +18,18 @@ import (
 // SetCommandFlags creates flags and bind them to Viper.
 func SetCommandFlags(fs *pflag.FlagSet, v *viper.Viper) {
 	fs.StringP("config-file", "c", "qproxy.yaml", "Configuration file")
+	fs.String("log-level", "info", "Log level")
+	fs.String("log-format", logFormatText, "Log format, text or json")
+	fs.String("log-output", logOutputStderr, "Log output, stdout, stderr, file or syslog")
+	fs.String("log-file", "", "Log file, when the log output is file")
 
 	fs.VisitAll(func(f *pflag.Flag) {
 		v.BindPFlag(strings.ReplaceAll(f.Name, "-", "_"), fs.Lookup(f.Name))
 	})
+	v.BindPFlag("log.level", fs.Lookup("log-level"))
+	v.BindPFlag("log.format", fs.Lookup("log-format"))
+	v.BindPFlag("log.output", fs.Lookup("log-output"))
+	v.BindPFlag("log.file", fs.Lookup("log-file"))
 }
 
 // InitConfig reads in config file
@@ -37,8 +46,252 @@ type backendConfig struct {
 	url         string
 	sessionTTL  time.Duration
 	maxSessions int
-	tlsInsecure bool
 	weight      float64
+	tls         backendTLSConfig
+	transport   transportConfig
+	requests    requestsConfig
+
+	reservedSessions int
+}
+
+type requestsConfig struct {
+	maxInFlight  int
+	queueSize    int
+	queueTimeout time.Duration
+}
+
+type backendTLSConfig struct {
+	insecure   bool
+	caFile     string
+	certFile   string
+	keyFile    string
+	serverName string
+}
+
+type transportConfig struct {
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	idleConnTimeout       time.Duration
+	maxConnsPerHost       int
+	maxIdleConnsPerHost   int
+	keepAlive             bool
+	http2                 bool
+}
+
+func setBackendConfigDefaults(v *viper.Viper) {
+	v.SetDefault("weight", 1)
+	v.SetDefault("transport.dial_timeout", 5)
+	v.SetDefault("transport.tls_handshake_timeout", 5)
+	v.SetDefault("transport.idle_conn_timeout", 300)
+	v.SetDefault("transport.max_idle_conns_per_host", v.GetInt("max_sessions"))
+	v.SetDefault("transport.keep_alive", true)
+	v.SetDefault("transport.http2", true)
+	v.SetDefault("requests.queue_timeout", 5)
+}
+
+func newBackendConfig(v *viper.Viper) *backendConfig {
+	setBackendConfigDefaults(v)
+
+	return &backendConfig{
+		url:         v.GetString("url"),
+		sessionTTL:  v.GetDuration("session_ttl") * time.Second,
+		maxSessions: v.GetInt("max_sessions"),
+		weight:      v.GetFloat64("weight"),
+		tls: backendTLSConfig{
+			insecure:   v.GetBool("tls.insecure"),
+			caFile:     v.GetString("tls.ca_file"),
+			certFile:   v.GetString("tls.cert_file"),
+			keyFile:    v.GetString("tls.key_file"),
+			serverName: v.GetString("tls.server_name"),
+		},
+		transport: transportConfig{
+			dialTimeout:           v.GetDuration("transport.dial_timeout") * time.Second,
+			tlsHandshakeTimeout:   v.GetDuration("transport.tls_handshake_timeout") * time.Second,
+			responseHeaderTimeout: v.GetDuration("transport.response_header_timeout") * time.Second,
+			idleConnTimeout:       v.GetDuration("transport.idle_conn_timeout") * time.Second,
+			maxConnsPerHost:       v.GetInt("transport.max_conns_per_host"),
+			maxIdleConnsPerHost:   v.GetInt("transport.max_idle_conns_per_host"),
+			keepAlive:             v.GetBool("transport.keep_alive"),
+			http2:                 v.GetBool("transport.http2"),
+		},
+		requests: requestsConfig{
+			maxInFlight:  v.GetInt("requests.max_in_flight"),
+			queueSize:    v.GetInt("requests.queue_size"),
+			queueTimeout: v.GetDuration("requests.queue_timeout") * time.Second,
+		},
+	}
+}
+
+type poolConfig struct {
+	cookieName          string
+	whitelistCookieName string
+	queuedSessionTTL    time.Duration
+	maxQueuedSessions   int
+	lanes               []string
+	template            *template.Template
+	fullTemplate        *template.Template
+	quotas              *quotasConfig
+	backends            map[string]*backendConfig
+}
+
+// setPoolConfigDefaults makes the options of a pool default to the top-level
+// ones, the cookie name is suffixed with the pool name.
+func setPoolConfigDefaults(name string, v *viper.Viper, parent *viper.Viper) {
+	v.SetDefault("cookie_name", parent.GetString("cookie_name")+"_"+name)
+	v.SetDefault("queue.session_ttl", parent.Get("queue.session_ttl"))
+	v.SetDefault("queue.max_sessions", parent.Get("queue.max_sessions"))
+	v.SetDefault("queue.lanes", parent.Get("queue.lanes"))
+	v.SetDefault("queue.template", parent.Get("queue.template"))
+	v.SetDefault("queue.full_template", parent.Get("queue.full_template"))
+	v.SetDefault("quotas.max_queued_sessions_per_ip", parent.Get("quotas.max_queued_sessions_per_ip"))
+	v.SetDefault("quotas.max_sessions_per_ip", parent.Get("quotas.max_sessions_per_ip"))
+	v.SetDefault("quotas.ipv6_prefix", parent.Get("quotas.ipv6_prefix"))
+	v.SetDefault("quotas.template", parent.Get("quotas.template"))
+}
+
+func newPoolConfig(v *viper.Viper) (*poolConfig, error) {
+	queueTemplate, err := template.ParseFiles(v.GetString("queue.template"))
+	if err != nil {
+		return nil, err
+	}
+
+	fullQueueTemplate, err := template.ParseFiles(v.GetString("queue.full_template"))
+	if err != nil {
+		return nil, err
+	}
+
+	quotas, err := newQuotasConfig(v)
+	if err != nil {
+		return nil, err
+	}
+
+	backendsConfigMap := make(map[string]*backendConfig)
+	for backendName := range v.GetStringMap("backends") {
+		backendsConfigMap[backendName] = newBackendConfig(v.Sub("backends." + backendName))
+	}
+
+	return &poolConfig{
+		cookieName:        v.GetString("cookie_name"),
+		queuedSessionTTL:  v.GetDuration("queue.session_ttl") * time.Second,
+		maxQueuedSessions: v.GetInt("queue.max_sessions"),
+		lanes:             v.GetStringSlice("queue.lanes"),
+		template:          queueTemplate,
+		fullTemplate:      fullQueueTemplate,
+		quotas:            quotas,
+		backends:          backendsConfigMap,
+	}, nil
+}
+
+type roomConfig struct {
+	hosts        []string
+	pathPrefix   string
+	pools        map[string]*poolConfig
+	routes       []*routeConfig
+	schedule     *scheduleConfig
+	gate         *gateConfig
+	rules        []*requestRule
+	denyTemplate *template.Template
+	bypassTokens *bypassTokensConfig
+	invitations  *invitationsConfig
+	handshake    *handshakeConfig
+	challenge    *challengeConfig
+	binding      *bindingConfig
+}
+
+// newRoomConfig reads the options of a room, the top-level options describe
+// the default room.
+func newRoomConfig(v *viper.Viper) (*roomConfig, error) {
+	defaultPoolConfig, err := newPoolConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	defaultPoolConfig.whitelistCookieName = v.GetString("whitelist.cookie_name")
+
+	poolsConfigMap := map[string]*poolConfig{defaultPoolName: defaultPoolConfig}
+	for poolName := range v.GetStringMap("pools") {
+		rawPoolConfig := v.Sub("pools." + poolName)
+		setPoolConfigDefaults(poolName, rawPoolConfig, v)
+		poolConfig, err := newPoolConfig(rawPoolConfig)
+		if err != nil {
+			return nil, fmt.Errorf("[pool: %s] %s", poolName, err)
+		}
+		if whitelistCookieName := v.GetString("whitelist.cookie_name"); whitelistCookieName != "" {
+			poolConfig.whitelistCookieName = whitelistCookieName + "_" + poolName
+		}
+
+		poolsConfigMap[poolName] = poolConfig
+	}
+
+	routes, err := newRoutesConfig(v)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule, err := newScheduleConfig(v)
+	if err != nil {
+		return nil, err
+	}
+
+	gate, err := newGateConfig(v)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := newRequestRules(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var denyTemplate *template.Template
+	if v.GetString("deny_template") != "" {
+		denyTemplate, err = template.ParseFiles(v.GetString("deny_template"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	invitations, err := newInvitationsConfig(v)
+	if err != nil {
+		return nil, err
+	}
+
+	handshake, err := newHandshakeConfig(v)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := newChallengeConfig(v)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, poolConfig := range poolsConfigMap {
+		for _, backendConfig := range poolConfig.backends {
+			backendConfig.reservedSessions = int(float64(backendConfig.maxSessions) * invitations.reservedShare)
+		}
+	}
+
+	hosts := make([]string, 0)
+	for _, host := range v.GetStringSlice("hosts") {
+		hosts = append(hosts, strings.ToLower(host))
+	}
+
+	return &roomConfig{
+		hosts:        hosts,
+		pathPrefix:   v.GetString("path_prefix"),
+		pools:        poolsConfigMap,
+		routes:       routes,
+		schedule:     schedule,
+		gate:         gate,
+		rules:        rules,
+		denyTemplate: denyTemplate,
+		bypassTokens: newBypassTokensConfig(v),
+		invitations:  invitations,
+		handshake:    handshake,
+		challenge:    challenge,
+		binding:      newBindingConfig(v),
+	}, nil
 }
 
 type proxyConfig struct {
@@ -62,7 +315,6 @@ func newQProxyConfig(v *viper.Viper) (*proxyConfig, error) {
 	}
 
 	config.m.Store("addr", v.GetString("addr"))
-	config.m.Store("cookie_name", v.GetString("cookie_name"))
 	config.m.Store("timeout", v.GetDuration("timeout")*time.Second)
 	config.m.Store("tls.cert_file", v.GetString("tls.cert_file"))
 	config.m.Store("tls.key_file", v.GetString("tls.key_file"))
@@ -76,7 +328,7 @@ func newQProxyConfig(v *viper.Viper) (*proxyConfig, error) {
 func (c *proxyConfig) getValue(key string) interface{} {
 	value, ok := c.m.Load(key)
 	if !ok {
-		log.WithFields(log.Fields{"key": key}).Fatal("Unknown configuration key")
+		configLog.WithFields(log.Fields{"key": key}).Fatal("Unknown configuration key")
 	}
 
 	return value
@@ -86,6 +338,10 @@ func (c *proxyConfig) getString(key string) string {
 	return c.getValue(key).(string)
 }
 
+func (c *proxyConfig) getStringSlice(key string) []string {
+	return c.getValue(key).([]string)
+}
+
 func (c *proxyConfig) getDuration(key string) time.Duration {
 	return c.getValue(key).(time.Duration)
 }
@@ -94,16 +350,44 @@ func (c *proxyConfig) getIPList(key string) *ipList {
 	return c.getValue(key).(*ipList)
 }
 
+func (c *proxyConfig) getBool(key string) bool {
+	return c.getValue(key).(bool)
+}
+
 func (c *proxyConfig) getInt(key string) int {
 	return c.getValue(key).(int)
 }
 
-func (c *proxyConfig) getTemplate(key string) *template.Template {
-	return c.getValue(key).(*template.Template)
+func (c *proxyConfig) getLoggingConfig() *loggingConfig {
+	return c.getValue("log").(*loggingConfig)
+}
+
+func (c *proxyConfig) getAccessLogConfig() *accessLogConfig {
+	return c.getValue("access_log").(*accessLogConfig)
 }
 
-func (c *proxyConfig) getBackendsConfig() map[string]*backendConfig {
-	return c.getValue("backends_config_map").(map[string]*backendConfig)
+func (c *proxyConfig) getHistoryConfig() *historyConfig {
+	return c.getValue("history").(*historyConfig)
+}
+
+func (c *proxyConfig) getEventsConfig() *eventsConfig {
+	return c.getValue("events").(*eventsConfig)
+}
+
+func (c *proxyConfig) getAlertRules() []*alertRule {
+	return c.getValue("alerts").([]*alertRule)
+}
+
+func (c *proxyConfig) getStatsdConfig() *statsdConfig {
+	return c.getValue("statsd").(*statsdConfig)
+}
+
+func (c *proxyConfig) getTracingConfig() *tracingConfig {
+	return c.getValue("tracing").(*tracingConfig)
+}
+
+func (c *proxyConfig) getRoomsConfig() map[string]*roomConfig {
+	return c.getValue("rooms_config_map").(map[string]*roomConfig)
 }
 
 func (c *proxyConfig) loadDynamicConfig() error {
@@ -117,38 +401,47 @@ func (c *proxyConfig) loadDynamicConfig() error {
 		return err
 	}
 
-	queueTemplate, err := template.ParseFiles(c.v.GetString("queue.template"))
+	loggingConfig, err := newLoggingConfig(c.v)
 	if err != nil {
 		return err
 	}
 
-	fullQueueTemplate, err := template.ParseFiles(c.v.GetString("queue.full_template"))
+	alertRules, err := newAlertRules(c.v)
 	if err != nil {
 		return err
 	}
 
-	backendsConfigMap := make(map[string]*backendConfig)
-	for backendName := range c.v.GetStringMap("backends") {
-		rawBackendConfig := c.v.Sub("backends." + backendName)
-		backendsConfigMap[backendName] = &backendConfig{
-			url:         rawBackendConfig.GetString("url"),
-			sessionTTL:  rawBackendConfig.GetDuration("session_ttl") * time.Second,
-			maxSessions: rawBackendConfig.GetInt("max_sessions"),
-			tlsInsecure: rawBackendConfig.GetBool("tls.insecure"),
-			weight:      rawBackendConfig.GetFloat64("weight"),
+	defaultRoomConfig, err := newRoomConfig(c.v)
+	if err != nil {
+		return err
+	}
+
+	roomsConfigMap := map[string]*roomConfig{defaultRoomName: defaultRoomConfig}
+	for roomName := range c.v.GetStringMap("rooms") {
+		roomConfig, err := newRoomConfig(c.v.Sub("rooms." + roomName))
+		if err != nil {
+			return fmt.Errorf("[room: %s] %s", roomName, err)
 		}
+
+		roomsConfigMap[roomName] = roomConfig
 	}
 
 	c.m.Store("trusted_proxies", trustedProxies)
 	c.m.Store("whitelisted_ips", whitelistedIps)
 	c.m.Store("session_refresh_interval", c.v.GetDuration("session_refresh_interval")*time.Second)
-	c.m.Store("queue.session_ttl", c.v.GetDuration("queue.session_ttl")*time.Second)
-	c.m.Store("queue.max_sessions", c.v.GetInt("queue.max_sessions"))
-	c.m.Store("queue.template", queueTemplate)
-	c.m.Store("queue.full_template", fullQueueTemplate)
-	c.m.Store("backends_config_map", backendsConfigMap)
+	c.m.Store("rooms_config_map", roomsConfigMap)
+	c.m.Store("access_log", newAccessLogConfig(c.v))
+	c.m.Store("log", loggingConfig)
+	c.m.Store("history", newHistoryConfig(c.v))
+	c.m.Store("events", newEventsConfig(c.v))
+	c.m.Store("alerts", alertRules)
+	c.m.Store("statsd", newStatsdConfig(c.v))
+	c.m.Store("tracing", newTracingConfig(c.v))
 	c.m.Store("api.username", c.v.GetString("api.username"))
 	c.m.Store("api.password", c.v.GetString("api.password"))
+	c.m.Store("whitelist.consume_capacity", c.v.GetBool("whitelist.consume_capacity"))
+	c.m.Store("retry.max_attempts", c.v.GetInt("retry.max_attempts"))
+	c.m.Store("retry.methods", c.v.GetStringSlice("retry.methods"))
 
 	return nil
 }
@@ -204,10 +497,181 @@ func ValidateProxyConfig(v *viper.Viper) error {
 		}
 	}
 
+	v.SetDefault("retry.methods", []string{http.MethodGet, http.MethodHead, http.MethodOptions})
+
 	if v.GetInt("queue.max_sessions") < 0 {
 		return errors.New("Option `queue.max_sessions` must be greater or equals than 0")
 	}
 
+	if err := validateQuotasConfig(v); err != nil {
+		return err
+	}
+
+	if v.GetInt("retry.max_attempts") < 0 {
+		return errors.New("Option `retry.max_attempts` must be greater or equals than 0")
+	}
+
+	if err := validateAccessLogConfig(v); err != nil {
+		return err
+	}
+
+	if err := validateLoggingConfig(v); err != nil {
+		return err
+	}
+
+	if err := validateHistoryConfig(v); err != nil {
+		return err
+	}
+
+	if err := validateEventsConfig(v); err != nil {
+		return err
+	}
+
+	if err := validateAlertRules(v); err != nil {
+		return err
+	}
+
+	if err := validateStatsdConfig(v); err != nil {
+		return err
+	}
+
+	if err := validateTracingConfig(v); err != nil {
+		return err
+	}
+
+	if err := validateWhitelistCookieName(v); err != nil {
+		return err
+	}
+
+	if err := validateBackendsConfig(v); err != nil {
+		return err
+	}
+
+	cookieNames := make(map[string]bool)
+	if err := validateRoomConfig(v, cookieNames); err != nil {
+		return err
+	}
+
+	for roomName := range v.GetStringMap("rooms") {
+		if roomName == defaultRoomName {
+			return fmt.Errorf("Room name `%s` is reserved", defaultRoomName)
+		}
+
+		if err := validateNamedRoomConfig(v.Sub("rooms."+roomName), cookieNames); err != nil {
+			return fmt.Errorf("[room: %s] %s", roomName, err)
+		}
+	}
+
+	return nil
+}
+
+func validateNamedRoomConfig(v *viper.Viper, cookieNames map[string]bool) error {
+	if v == nil || (len(v.GetStringSlice("hosts")) == 0 && v.GetString("path_prefix") == "") {
+		return errors.New("Missing `hosts` or `path_prefix` option")
+	}
+
+	if err := validatePoolConfig(v); err != nil {
+		return err
+	}
+
+	if err := validateWhitelistCookieName(v); err != nil {
+		return err
+	}
+
+	return validateRoomConfig(v, cookieNames)
+}
+
+// validateRoomConfig validates the pools and the routes of a room, cookie names
+// are added to cookieNames as they must be unique across rooms and pools.
+func validateRoomConfig(v *viper.Viper, cookieNames map[string]bool) error {
+	if cookieNames[v.GetString("cookie_name")] {
+		return errors.New("Option `cookie_name` must be unique")
+	}
+	cookieNames[v.GetString("cookie_name")] = true
+
+	for poolName := range v.GetStringMap("pools") {
+		if poolName == defaultPoolName {
+			return fmt.Errorf("Pool name `%s` is reserved", defaultPoolName)
+		}
+
+		poolConfig := v.Sub("pools." + poolName)
+		if poolConfig == nil {
+			return fmt.Errorf("[pool: %s] No backends available", poolName)
+		}
+
+		setPoolConfigDefaults(poolName, poolConfig, v)
+		if err := validatePoolConfig(poolConfig); err != nil {
+			return fmt.Errorf("[pool: %s] %s", poolName, err)
+		}
+
+		if cookieNames[poolConfig.GetString("cookie_name")] {
+			return fmt.Errorf("[pool: %s] Option `cookie_name` must be unique", poolName)
+		}
+		cookieNames[poolConfig.GetString("cookie_name")] = true
+	}
+
+	if err := validateRoutesConfig(v); err != nil {
+		return err
+	}
+
+	if err := validateScheduleConfig(v); err != nil {
+		return err
+	}
+
+	if err := validateGateConfig(v); err != nil {
+		return err
+	}
+
+	if err := validateRequestRules(v); err != nil {
+		return err
+	}
+
+	if err := validateInvitationsConfig(v); err != nil {
+		return err
+	}
+
+	if err := validateHandshakeConfig(v); err != nil {
+		return err
+	}
+
+	if err := validateChallengeConfig(v); err != nil {
+		return err
+	}
+
+	return validateBindingConfig(v)
+}
+
+func validateWhitelistCookieName(v *viper.Viper) error {
+	if v.GetString("whitelist.cookie_name") != "" && v.GetString("whitelist.cookie_name") == v.GetString("cookie_name") {
+		return errors.New("Option `whitelist.cookie_name` must be different from `cookie_name`")
+	}
+
+	return nil
+}
+
+func validatePoolConfig(v *viper.Viper) error {
+	for _, key := range []string{"cookie_name", "queue.template", "queue.full_template"} {
+		if v.GetString(key) == "" {
+			return fmt.Errorf("Missing `%s` option", key)
+		}
+	}
+
+	if v.GetDuration("queue.session_ttl") == time.Duration(0) {
+		return errors.New("Option `queue.session_ttl` must be greater than 0")
+	}
+
+	if v.GetInt("queue.max_sessions") < 0 {
+		return errors.New("Option `queue.max_sessions` must be greater or equals than 0")
+	}
+
+	if err := validateQuotasConfig(v); err != nil {
+		return err
+	}
+
+	return validateBackendsConfig(v)
+}
+
+func validateBackendsConfig(v *viper.Viper) error {
 	if len(v.GetStringMap("backends")) == 0 {
 		return errors.New("No backends available")
 	}
@@ -223,7 +687,7 @@ func ValidateProxyConfig(v *viper.Viper) error {
 }
 
 func validateBackendConfig(v *viper.Viper) error {
-	v.SetDefault("weight", 1)
+	setBackendConfigDefaults(v)
 
 	if v.GetString("url") == "" {
 		return errors.New("Missing `url` option")
@@ -245,5 +709,26 @@ func validateBackendConfig(v *viper.Viper) error {
 		return errors.New("Option `weight` must be less or equals than 1")
 	}
 
+	if (v.GetString("tls.cert_file") == "") != (v.GetString("tls.key_file") == "") {
+		return errors.New("Options `tls.cert_file` and `tls.key_file` must be set together")
+	}
+
+	durationOptions := []string{"transport.dial_timeout", "transport.tls_handshake_timeout",
+		"transport.response_header_timeout", "transport.idle_conn_timeout", "requests.queue_timeout",
+	}
+	for _, key := range durationOptions {
+		if v.GetDuration(key) < 0 {
+			return fmt.Errorf("Option `%s` must be greater or equals than 0", key)
+		}
+	}
+
+	for _, key := range []string{"transport.max_conns_per_host", "transport.max_idle_conns_per_host",
+		"requests.max_in_flight", "requests.queue_size",
+	} {
+		if v.GetInt(key) < 0 {
+			return fmt.Errorf("Option `%s` must be greater or equals than 0", key)
+		}
+	}
+
 	return nil
 }
@@ -49,6 +49,20 @@ func TestNegativeMaxSessions(t *testing.T) {
 	assert.EqualError(t, err, "Option `queue.max_sessions` must be greater or equals than 0")
 }
 
+func TestNegativeRetryAttempts(t *testing.T) {
+	v := newViper()
+	v.Set("retry.max_attempts", -1)
+	err := ValidateProxyConfig(v)
+	assert.EqualError(t, err, "Option `retry.max_attempts` must be greater or equals than 0")
+}
+
+func TestWhitelistCookieName(t *testing.T) {
+	v := newViper()
+	v.Set("whitelist.cookie_name", "qpid")
+	err := ValidateProxyConfig(v)
+	assert.EqualError(t, err, "Option `whitelist.cookie_name` must be different from `cookie_name`")
+}
+
 func TestMissingBackends(t *testing.T) {
 	err := ValidateProxyConfig(newViper())
 	assert.EqualError(t, err, "No backends available")
@@ -72,6 +86,73 @@ func TestBackendConfig(t *testing.T) {
 
 	v.Set("backends.a.weight", 2)
 	assert.EqualError(t, ValidateProxyConfig(v), "[backend: a] Option `weight` must be less or equals than 1")
+
+	v.Set("backends.a.weight", 1)
+	v.Set("backends.a.tls.cert_file", "cert.pem")
+	assert.EqualError(t, ValidateProxyConfig(v), "[backend: a] Options `tls.cert_file` and `tls.key_file` must be set together")
+
+	v.Set("backends.a.tls.key_file", "key.pem")
+	v.Set("backends.a.transport.dial_timeout", -1)
+	assert.EqualError(t, ValidateProxyConfig(v), "[backend: a] Option `transport.dial_timeout` must be greater or equals than 0")
+
+	v.Set("backends.a.transport.dial_timeout", 1)
+	v.Set("backends.a.transport.max_conns_per_host", -1)
+	assert.EqualError(t, ValidateProxyConfig(v), "[backend: a] Option `transport.max_conns_per_host` must be greater or equals than 0")
+}
+
+func TestPoolConfig(t *testing.T) {
+	v := newViper()
+	v.Set("backends.a.url", "foo")
+	v.Set("backends.a.session_ttl", 1)
+	v.Set("backends.a.max_sessions", 1)
+
+	v.Set("pools.default.queue.max_sessions", 1)
+	assert.EqualError(t, ValidateProxyConfig(v), "Pool name `default` is reserved")
+
+	v.Set("pools", map[string]interface{}{"shop": map[string]interface{}{"cookie_name": "qpid"}})
+	assert.EqualError(t, ValidateProxyConfig(v), "[pool: shop] No backends available")
+
+	v.Set("pools.shop.backends.a.url", "foo")
+	v.Set("pools.shop.backends.a.session_ttl", 1)
+	v.Set("pools.shop.backends.a.max_sessions", 1)
+	assert.EqualError(t, ValidateProxyConfig(v), "[pool: shop] Option `cookie_name` must be unique")
+
+	v.Set("pools.shop.cookie_name", "shop")
+	v.Set("routes", []map[string]interface{}{{"pool": "shop"}})
+	assert.EqualError(t, ValidateProxyConfig(v), "[route] Missing `host` or `path_prefix` option")
+
+	v.Set("routes", []map[string]interface{}{{"host": "shop.example.com", "pool": "blog"}})
+	assert.EqualError(t, ValidateProxyConfig(v), "[route] Unknown pool `blog`")
+
+	v.Set("routes", []map[string]interface{}{{"host": "shop.example.com", "pool": "shop"}})
+	assert.NoError(t, ValidateProxyConfig(v))
+}
+
+func TestRoomConfig(t *testing.T) {
+	v := newViper()
+	v.Set("backends.a.url", "foo")
+	v.Set("backends.a.session_ttl", 1)
+	v.Set("backends.a.max_sessions", 1)
+
+	v.Set("rooms.default.hosts", []string{"shop.example.com"})
+	assert.EqualError(t, ValidateProxyConfig(v), "Room name `default` is reserved")
+
+	v.Set("rooms", map[string]interface{}{"shop": map[string]interface{}{"cookie_name": "qpid"}})
+	assert.EqualError(t, ValidateProxyConfig(v), "[room: shop] Missing `hosts` or `path_prefix` option")
+
+	v.Set("rooms.shop.hosts", []string{"shop.example.com"})
+	assert.EqualError(t, ValidateProxyConfig(v), "[room: shop] Missing `queue.template` option")
+
+	v.Set("rooms.shop.queue.template", "template.html")
+	v.Set("rooms.shop.queue.full_template", "template.html")
+	v.Set("rooms.shop.queue.session_ttl", 1)
+	v.Set("rooms.shop.backends.a.url", "foo")
+	v.Set("rooms.shop.backends.a.session_ttl", 1)
+	v.Set("rooms.shop.backends.a.max_sessions", 1)
+	assert.EqualError(t, ValidateProxyConfig(v), "[room: shop] Option `cookie_name` must be unique")
+
+	v.Set("rooms.shop.cookie_name", "shop")
+	assert.NoError(t, ValidateProxyConfig(v))
 }
 
 func newViper() *viper.Viper {
@@ -0,0 +1,213 @@
+package qproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EventSink receives the session events by batches. Send is retried with a
+// backoff when it fails, Close is called once the last batch has been sent.
+type EventSink interface {
+	Send(events []*Event) error
+	Close() error
+}
+
+// AddEventSink registers a sink receiving the session events, it is kept when
+// the configuration is reloaded.
+func (qp *QProxy) AddEventSink(sink EventSink) {
+	qp.events.addSink(sink, qp.config.getEventsConfig())
+}
+
+// eventSinkRunner batches the events of a sink and sends them from its own
+// goroutine.
+type eventSinkRunner struct {
+	sink          EventSink
+	events        chan *Event
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+	done          chan struct{}
+	stopped       chan struct{}
+}
+
+func newEventSinkRunner(sink EventSink, config *eventsConfig) *eventSinkRunner {
+	runner := &eventSinkRunner{
+		sink:          sink,
+		events:        make(chan *Event, config.batchSize*10),
+		batchSize:     config.batchSize,
+		flushInterval: config.flushInterval,
+		maxRetries:    config.maxRetries,
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	go runner.run()
+
+	return runner
+}
+
+func (runner *eventSinkRunner) run() {
+	defer close(runner.stopped)
+
+	ticker := time.NewTicker(runner.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Event, 0, runner.batchSize)
+	for {
+		select {
+		case e := <-runner.events:
+			batch = append(batch, e)
+			if len(batch) >= runner.batchSize {
+				batch = runner.flush(batch)
+			}
+		case <-ticker.C:
+			batch = runner.flush(batch)
+		case <-runner.done:
+			runner.flush(append(batch, runner.drain()...))
+			if err := runner.sink.Close(); err != nil {
+				proxyLog.WithFields(log.Fields{"error": err}).Error("Unable to close event sink")
+			}
+			return
+		}
+	}
+}
+
+// drain returns the events waiting in the runner buffer.
+func (runner *eventSinkRunner) drain() []*Event {
+	events := make([]*Event, 0)
+	for {
+		select {
+		case e := <-runner.events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+// flush sends the batch and returns an empty batch, the events are dropped
+// once the retries are exhausted.
+func (runner *eventSinkRunner) flush(batch []*Event) []*Event {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	backoff := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := runner.sink.Send(batch)
+		if err == nil {
+			break
+		}
+
+		if attempt >= runner.maxRetries {
+			proxyLog.WithFields(log.Fields{"error": err, "events": len(batch)}).Error("Unable to send events, events dropped")
+			break
+		}
+
+		proxyLog.WithFields(log.Fields{"error": err, "events": len(batch)}).Warning("Unable to send events, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	return make([]*Event, 0, runner.batchSize)
+}
+
+// stop sends the pending events and waits for the runner to end.
+func (runner *eventSinkRunner) stop() {
+	close(runner.done)
+	<-runner.stopped
+}
+
+func encodeEvents(events []*Event) ([]byte, error) {
+	buf := bytes.Buffer{}
+	encoder := json.NewEncoder(&buf)
+	for _, e := range events {
+		if err := encoder.Encode(e); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// fileEventSink appends the events as NDJSON to a file.
+type fileEventSink struct {
+	lock sync.Mutex
+	file *rotatingFile
+}
+
+func newFileEventSink(path string) (*fileEventSink, error) {
+	file, err := openRotatingFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileEventSink{file: file}, nil
+}
+
+func (sink *fileEventSink) Send(events []*Event) error {
+	data, err := encodeEvents(events)
+	if err != nil {
+		return err
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	return sink.file.write(data)
+}
+
+func (sink *fileEventSink) reopen() error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	return sink.file.reopen()
+}
+
+func (sink *fileEventSink) Close() error {
+	sink.lock.Lock()
+	sink.file.close()
+	sink.lock.Unlock()
+
+	return nil
+}
+
+// webhookEventSink posts the events as NDJSON to an HTTP endpoint.
+type webhookEventSink struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookEventSink(url string, timeout time.Duration) *webhookEventSink {
+	return &webhookEventSink{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func (sink *webhookEventSink) Send(events []*Event) error {
+	data, err := encodeEvents(events)
+	if err != nil {
+		return err
+	}
+
+	resp, err := sink.client.Post(sink.url, "application/x-ndjson", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook answered with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (sink *webhookEventSink) Close() error {
+	sink.client.CloseIdleConnections()
+
+	return nil
+}
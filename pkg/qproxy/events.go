@@ -0,0 +1,366 @@
+package qproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	eventSessionCreated  = "session_created"
+	eventSessionQueued   = "session_queued"
+	eventSessionAdmitted = "session_admitted"
+	eventSessionExpired  = "session_expired"
+	eventSessionEvicted  = "session_evicted"
+	eventSessionMigrated = "session_migrated"
+
+	// subscriberBufferSize is the number of events kept for a slow stream
+	// client before its events are dropped.
+	subscriberBufferSize = 1000
+	sseHeartbeatInterval = 15 * time.Second
+)
+
+// eventsConfig holds the events options, bufferSize is only applied when QProxy
+// is created.
+type eventsConfig struct {
+	bufferSize     int
+	file           string
+	webhookURL     string
+	webhookTimeout time.Duration
+	batchSize      int
+	flushInterval  time.Duration
+	maxRetries     int
+}
+
+func newEventsConfig(v *viper.Viper) *eventsConfig {
+	v.SetDefault("events.buffer_size", 10000)
+	v.SetDefault("events.webhook.timeout", 5)
+	v.SetDefault("events.batch_size", 100)
+	v.SetDefault("events.flush_interval", 1)
+	v.SetDefault("events.max_retries", 3)
+
+	return &eventsConfig{
+		bufferSize:     v.GetInt("events.buffer_size"),
+		file:           v.GetString("events.file"),
+		webhookURL:     v.GetString("events.webhook.url"),
+		webhookTimeout: v.GetDuration("events.webhook.timeout") * time.Second,
+		batchSize:      v.GetInt("events.batch_size"),
+		flushInterval:  v.GetDuration("events.flush_interval") * time.Second,
+		maxRetries:     v.GetInt("events.max_retries"),
+	}
+}
+
+func validateEventsConfig(v *viper.Viper) error {
+	if v.GetInt("events.max_retries") < 0 {
+		return errors.New("Option `events.max_retries` must be greater or equals than 0")
+	}
+
+	for _, key := range []string{"events.buffer_size", "events.batch_size", "events.flush_interval", "events.webhook.timeout"} {
+		if v.IsSet(key) && v.GetInt(key) <= 0 {
+			return fmt.Errorf("Option `%s` must be greater than 0", key)
+		}
+	}
+
+	return nil
+}
+
+// Event describes a step in the lifecycle of a session. Waited is the time,
+// in seconds, spent in the queue by admitted and expired queued sessions,
+// From is the previous backend of migrated sessions.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Room    string    `json:"room"`
+	Pool    string    `json:"pool"`
+	Session string    `json:"session"`
+	Lane    string    `json:"lane,omitempty"`
+	Backend string    `json:"backend,omitempty"`
+	From    string    `json:"from,omitempty"`
+	State   string    `json:"state,omitempty"`
+	Waited  float64   `json:"waited,omitempty"`
+}
+
+// eventBus dispatches the events to the stream clients and the sinks. Events
+// are dropped instead of blocking the emitter when a buffer is full.
+type eventBus struct {
+	dropped     uint64
+	events      chan *Event
+	lock        sync.Mutex
+	config      *eventsConfig
+	subscribers map[chan *Event]bool
+	sinks       []*eventSinkRunner
+	custom      []*eventSinkRunner
+	closing     chan struct{}
+	closeOnce   sync.Once
+}
+
+func newEventBus(bufferSize int) *eventBus {
+	b := eventBus{
+		events:      make(chan *Event, bufferSize),
+		config:      &eventsConfig{},
+		subscribers: make(map[chan *Event]bool),
+		closing:     make(chan struct{}),
+	}
+	go b.dispatch()
+
+	return &b
+}
+
+func (b *eventBus) emit(e *Event) {
+	select {
+	case b.events <- e:
+	default:
+		atomic.AddUint64(&b.dropped, 1)
+	}
+}
+
+func (b *eventBus) dispatch() {
+	for {
+		select {
+		case e := <-b.events:
+			b.lock.Lock()
+			for subscriber := range b.subscribers {
+				b.offer(subscriber, e)
+			}
+			for _, runner := range b.sinks {
+				b.offer(runner.events, e)
+			}
+			for _, runner := range b.custom {
+				b.offer(runner.events, e)
+			}
+			b.lock.Unlock()
+		case <-b.closing:
+			return
+		}
+	}
+}
+
+func (b *eventBus) offer(events chan *Event, e *Event) {
+	select {
+	case events <- e:
+	default:
+		atomic.AddUint64(&b.dropped, 1)
+	}
+}
+
+// configure replaces the sinks described by the configuration when it
+// changes, pending events of the previous sinks are sent first.
+func (b *eventBus) configure(config *eventsConfig) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if *config == *b.config {
+		return nil
+	}
+
+	sinks := make([]*eventSinkRunner, 0)
+	if config.file != "" {
+		sink, err := newFileEventSink(config.file)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, newEventSinkRunner(sink, config))
+	}
+
+	if config.webhookURL != "" {
+		sinks = append(sinks, newEventSinkRunner(newWebhookEventSink(config.webhookURL, config.webhookTimeout), config))
+	}
+
+	for _, runner := range b.sinks {
+		runner.stop()
+	}
+	b.sinks = sinks
+	b.config = config
+
+	return nil
+}
+
+// addSink registers a sink which is kept when the configuration is reloaded.
+func (b *eventBus) addSink(sink EventSink, config *eventsConfig) {
+	b.lock.Lock()
+	b.custom = append(b.custom, newEventSinkRunner(sink, config))
+	b.lock.Unlock()
+}
+
+// reopen opens the files of the file sinks again, after they have been moved
+// by an external tool.
+func (b *eventBus) reopen() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, runner := range append(b.sinks, b.custom...) {
+		if sink, ok := runner.sink.(*fileEventSink); ok {
+			if err := sink.reopen(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// shutdown ends the streams and sends the pending events to the sinks.
+func (b *eventBus) shutdown() {
+	b.closeOnce.Do(func() {
+		close(b.closing)
+
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		for pending := true; pending; {
+			select {
+			case e := <-b.events:
+				for _, runner := range append(b.sinks, b.custom...) {
+					b.offer(runner.events, e)
+				}
+			default:
+				pending = false
+			}
+		}
+		for _, runner := range append(b.sinks, b.custom...) {
+			runner.stop()
+		}
+		b.sinks, b.custom = nil, nil
+	})
+}
+
+func (b *eventBus) subscribe() chan *Event {
+	events := make(chan *Event, subscriberBufferSize)
+	b.lock.Lock()
+	b.subscribers[events] = true
+	b.lock.Unlock()
+
+	return events
+}
+
+func (b *eventBus) unsubscribe(events chan *Event) {
+	b.lock.Lock()
+	delete(b.subscribers, events)
+	b.lock.Unlock()
+}
+
+// ServeHTTP streams the events as server-sent events when the client accepts
+// `text/event-stream`, as NDJSON otherwise. The `type` parameter, repeated or
+// comma separated, keeps only the given event types.
+func (b *eventBus) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	types := make(map[string]bool)
+	for _, value := range r.URL.Query()["type"] {
+		for _, eventType := range strings.Split(value, ",") {
+			types[strings.TrimSpace(eventType)] = true
+		}
+	}
+
+	events := b.subscribe()
+	defer b.unsubscribe(events)
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		rw.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		rw.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e := <-events:
+			if len(types) > 0 && !types[e.Type] {
+				continue
+			}
+
+			data, err := json.Marshal(e)
+			if err != nil {
+				apiLog.WithFields(log.Fields{"error": err}).Error("Unable to encode event")
+				continue
+			}
+
+			if sse {
+				_, err = fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", e.Type, data)
+			} else {
+				_, err = rw.Write(append(data, '\n'))
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if sse {
+				rw.Write([]byte(":\n\n"))
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		case <-b.closing:
+			return
+		}
+	}
+}
+
+// poolEvents emits the events of a pool, with the room and pool names set.
+type poolEvents struct {
+	bus  *eventBus
+	room string
+	pool string
+}
+
+func (b *eventBus) forPool(roomName string, poolName string) *poolEvents {
+	return &poolEvents{bus: b, room: roomName, pool: poolName}
+}
+
+func (e *poolEvents) newEvent(eventType string, s *session, b *backend) *Event {
+	event := &Event{
+		Time:    time.Now(),
+		Type:    eventType,
+		Room:    e.room,
+		Pool:    e.pool,
+		Session: s.id,
+		Lane:    s.lane,
+	}
+	if b != nil {
+		event.Backend = b.name
+	}
+
+	return event
+}
+
+// emit sends an event about the session, b is the backend of the session, if
+// any.
+func (e *poolEvents) emit(eventType string, s *session, b *backend) {
+	e.bus.emit(e.newEvent(eventType, s, b))
+}
+
+func (e *poolEvents) emitAdmitted(s *session, b *backend, waited time.Duration) {
+	event := e.newEvent(eventSessionAdmitted, s, b)
+	event.Waited = waited.Seconds()
+	e.bus.emit(event)
+}
+
+func (e *poolEvents) emitExpired(s *session, b *backend, state string, waited time.Duration) {
+	event := e.newEvent(eventSessionExpired, s, b)
+	event.State = state
+	event.Waited = waited.Seconds()
+	e.bus.emit(event)
+}
+
+func (e *poolEvents) emitMigrated(s *session, from *backend, to *backend) {
+	event := e.newEvent(eventSessionMigrated, s, to)
+	event.From = from.name
+	e.bus.emit(event)
+}
@@ -0,0 +1,152 @@
+package qproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newEventsTestQProxy(t *testing.T, options map[string]interface{}) *QProxy {
+	config := newViper()
+	config.Set("backends.test.url", "http://"+testBackendAddr)
+	config.Set("backends.test.max_sessions", 1)
+	config.Set("backends.test.session_ttl", 5)
+	for key, value := range options {
+		config.Set(key, value)
+	}
+
+	qp, err := NewQProxy(config)
+	require.NoError(t, err)
+
+	return qp
+}
+
+func TestEventStream(t *testing.T) {
+	qp := newEventsTestQProxy(t, nil)
+	api := httptest.NewServer(newAPIHandler(qp))
+	defer api.Close()
+
+	resp, err := http.Get(api.URL + "/events?type=session_admitted,session_queued")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	pool := qp.defaultRoom().defaultPool()
+	admitted, _, ok := pool.syncNewSession("", nil, defaultLaneName, false)
+	require.True(t, ok)
+	queued, _, ok := pool.syncNewSession("", nil, defaultLaneName, false)
+	require.True(t, ok)
+
+	scanner := bufio.NewScanner(resp.Body)
+	events := make([]*Event, 0)
+	for len(events) < 2 && scanner.Scan() {
+		e := Event{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, &e)
+	}
+
+	require.Len(t, events, 2)
+	assert.Equal(t, eventSessionAdmitted, events[0].Type)
+	assert.Equal(t, admitted.id, events[0].Session)
+	assert.Equal(t, "test", events[0].Backend)
+	assert.Equal(t, defaultRoomName, events[0].Room)
+	assert.Equal(t, eventSessionQueued, events[1].Type)
+	assert.Equal(t, queued.id, events[1].Session)
+	assert.Equal(t, defaultLaneName, events[1].Lane)
+}
+
+func TestEventStreamSSE(t *testing.T) {
+	qp := newEventsTestQProxy(t, nil)
+	api := httptest.NewServer(newAPIHandler(qp))
+	defer api.Close()
+
+	r, err := http.NewRequest("GET", api.URL+"/events", nil)
+	require.NoError(t, err)
+	r.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(r)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	session, _, ok := qp.defaultRoom().defaultPool().syncNewSession("", nil, defaultLaneName, false)
+	require.True(t, ok)
+	qp.defaultRoom().defaultPool().syncRemoveSession(session.id)
+
+	reader := bufio.NewReader(resp.Body)
+	lines := make([]string, 0)
+	for len(lines) < 9 {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		lines = append(lines, strings.TrimSpace(line))
+	}
+
+	assert.Equal(t, "event: session_created", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "data: {"))
+	assert.Equal(t, "event: session_admitted", lines[3])
+	assert.Equal(t, "event: session_evicted", lines[6])
+}
+
+func TestEventSinks(t *testing.T) {
+	lock := sync.Mutex{}
+	calls := 0
+	received := make([]string, 0)
+	webhook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		calls++
+		if calls == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+	}))
+	defer webhook.Close()
+
+	dir, err := ioutil.TempDir("", "qproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "events.ndjson")
+	qp := newEventsTestQProxy(t, map[string]interface{}{
+		"events.file":           file,
+		"events.webhook.url":    webhook.URL,
+		"events.batch_size":     2,
+		"events.max_retries":    1,
+		"events.buffer_size":    100,
+		"events.flush_interval": 60,
+	})
+
+	pool := qp.defaultRoom().defaultPool()
+	for i := 0; i < 2; i++ {
+		_, _, ok := pool.syncNewSession("", nil, defaultLaneName, false)
+		require.True(t, ok)
+	}
+	time.Sleep(300 * time.Millisecond)
+	qp.events.shutdown()
+
+	content, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, 4, strings.Count(string(content), "\n"))
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, 3, calls)
+	require.Len(t, received, 4)
+
+	e := Event{}
+	require.NoError(t, json.Unmarshal([]byte(received[3]), &e))
+	assert.Equal(t, eventSessionQueued, e.Type)
+}
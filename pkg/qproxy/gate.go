@@ -0,0 +1,177 @@
+package qproxy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	gateActionQueue  = "queue"
+	gateActionBypass = "bypass"
+)
+
+// gateConfig decides which requests go through the session and queue logic,
+// requests bypassing the queue are proxied without a session.
+type gateConfig struct {
+	defaultAction string
+	rules         []*gateRule
+}
+
+// gateRule matches requests on path globs, methods and file extensions, each
+// non-empty criterion must match.
+type gateRule struct {
+	paths      []*regexp.Regexp
+	methods    []string
+	extensions []string
+	action     string
+}
+
+type rawGateRule struct {
+	Paths      []string `mapstructure:"paths"`
+	Methods    []string `mapstructure:"methods"`
+	Extensions []string `mapstructure:"extensions"`
+	Action     string   `mapstructure:"action"`
+}
+
+func newGateConfig(v *viper.Viper) (*gateConfig, error) {
+	rawRules := make([]rawGateRule, 0)
+	if err := v.UnmarshalKey("gate.rules", &rawRules); err != nil {
+		return nil, err
+	}
+
+	config := gateConfig{
+		defaultAction: v.GetString("gate.default"),
+		rules:         make([]*gateRule, 0),
+	}
+	if config.defaultAction == "" {
+		config.defaultAction = gateActionQueue
+	}
+
+	for _, rawRule := range rawRules {
+		rule := gateRule{
+			paths:      make([]*regexp.Regexp, 0),
+			methods:    make([]string, 0),
+			extensions: make([]string, 0),
+			action:     rawRule.Action,
+		}
+
+		for _, glob := range rawRule.Paths {
+			rule.paths = append(rule.paths, compileGlob(glob))
+		}
+
+		for _, method := range rawRule.Methods {
+			rule.methods = append(rule.methods, strings.ToUpper(method))
+		}
+
+		for _, extension := range rawRule.Extensions {
+			rule.extensions = append(rule.extensions, strings.ToLower(strings.TrimPrefix(extension, ".")))
+		}
+
+		config.rules = append(config.rules, &rule)
+	}
+
+	return &config, nil
+}
+
+func validateGateConfig(v *viper.Viper) error {
+	config, err := newGateConfig(v)
+	if err != nil {
+		return err
+	}
+
+	if !isGateAction(config.defaultAction) {
+		return fmt.Errorf("Option `gate.default` must be `%s` or `%s`", gateActionQueue, gateActionBypass)
+	}
+
+	for _, rule := range config.rules {
+		if !isGateAction(rule.action) {
+			return fmt.Errorf("[gate rule] Option `action` must be `%s` or `%s`", gateActionQueue, gateActionBypass)
+		}
+
+		if len(rule.paths) == 0 && len(rule.methods) == 0 && len(rule.extensions) == 0 {
+			return fmt.Errorf("[gate rule] Missing `paths`, `methods` or `extensions` option")
+		}
+	}
+
+	return nil
+}
+
+func isGateAction(action string) bool {
+	return action == gateActionQueue || action == gateActionBypass
+}
+
+// compileGlob converts a path glob to a regular expression, `*` matches any
+// characters, including `/`, and `?` matches a single character other than `/`.
+func compileGlob(glob string) *regexp.Regexp {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for _, char := range glob {
+		switch char {
+		case '*':
+			pattern.WriteString(".*")
+		case '?':
+			pattern.WriteString("[^/]")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	pattern.WriteString("$")
+
+	return regexp.MustCompile(pattern.String())
+}
+
+// bypasses tells if the request must be proxied without going through the
+// queue, the first matching rule decides.
+func (config *gateConfig) bypasses(r *http.Request) bool {
+	for _, rule := range config.rules {
+		if rule.matches(r) {
+			return rule.action == gateActionBypass
+		}
+	}
+
+	return config.defaultAction == gateActionBypass
+}
+
+func (rule *gateRule) matches(r *http.Request) bool {
+	if len(rule.paths) > 0 {
+		var matched bool
+		for _, glob := range rule.paths {
+			if glob.MatchString(r.URL.Path) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if len(rule.methods) > 0 && !containsString(rule.methods, r.Method) {
+		return false
+	}
+
+	if len(rule.extensions) > 0 {
+		extension := strings.ToLower(strings.TrimPrefix(path.Ext(r.URL.Path), "."))
+		if !containsString(rule.extensions, extension) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,51 @@
+package qproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGate(t *testing.T) {
+	v := viper.New()
+	v.Set("gate.rules", []map[string]interface{}{
+		{"paths": []string{"/static/*", "/status"}, "action": "bypass"},
+		{"extensions": []string{"css", ".PNG"}, "methods": []string{"get"}, "action": "bypass"},
+	})
+	gate, err := newGateConfig(v)
+	require.NoError(t, err)
+
+	assert.True(t, gate.bypasses(httptest.NewRequest("GET", "/static/css/main.css", nil)))
+	assert.True(t, gate.bypasses(httptest.NewRequest("POST", "/status", nil)))
+	assert.True(t, gate.bypasses(httptest.NewRequest("GET", "/img/logo.png", nil)))
+	assert.False(t, gate.bypasses(httptest.NewRequest("POST", "/img/logo.png", nil)))
+	assert.False(t, gate.bypasses(httptest.NewRequest("GET", "/status/details", nil)))
+	assert.False(t, gate.bypasses(httptest.NewRequest("GET", "/", nil)))
+
+	v = viper.New()
+	v.Set("gate.default", "bypass")
+	v.Set("gate.rules", []map[string]interface{}{
+		{"paths": []string{"/checkout/*"}, "action": "queue"},
+	})
+	gate, err = newGateConfig(v)
+	require.NoError(t, err)
+
+	assert.False(t, gate.bypasses(httptest.NewRequest("GET", "/checkout/cart", nil)))
+	assert.True(t, gate.bypasses(httptest.NewRequest("GET", "/products/1", nil)))
+}
+
+func TestGateConfig(t *testing.T) {
+	v := viper.New()
+	v.Set("gate.default", "deny")
+	assert.EqualError(t, validateGateConfig(v), "Option `gate.default` must be `queue` or `bypass`")
+
+	v.Set("gate.default", "bypass")
+	v.Set("gate.rules", []map[string]interface{}{{"paths": []string{"/checkout/*"}}})
+	assert.EqualError(t, validateGateConfig(v), "[gate rule] Option `action` must be `queue` or `bypass`")
+
+	v.Set("gate.rules", []map[string]interface{}{{"action": "queue"}})
+	assert.EqualError(t, validateGateConfig(v), "[gate rule] Missing `paths`, `methods` or `extensions` option")
+}
@@ -0,0 +1,141 @@
+package qproxy
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/spf13/viper"
+)
+
+const (
+	handshakeModeRedirect = "redirect"
+	handshakeModePage     = "page"
+)
+
+var defaultHandshakeTemplate = template.Must(template.New("handshake").Parse(`<!DOCTYPE html>
+<html>
+<head><meta http-equiv="refresh" content="0;url={{.URL}}"></head>
+<body><a href="{{.URL}}">Continue</a></body>
+</html>
+`))
+
+// handshakeConfig describes the first-visit handshake, new sessions are only
+// allocated to clients sending back the signed pre-session cookie.
+type handshakeConfig struct {
+	enabled    bool
+	mode       string
+	cookieName string
+	secret     []byte
+	ttl        time.Duration
+	template   *template.Template
+}
+
+func newHandshakeConfig(v *viper.Viper) (*handshakeConfig, error) {
+	v.SetDefault("handshake.mode", handshakeModeRedirect)
+	v.SetDefault("handshake.cookie_name", v.GetString("cookie_name")+"_handshake")
+	v.SetDefault("handshake.ttl", 300)
+
+	config := handshakeConfig{
+		enabled:    v.GetBool("handshake.enabled"),
+		mode:       v.GetString("handshake.mode"),
+		cookieName: v.GetString("handshake.cookie_name"),
+		secret:     []byte(v.GetString("handshake.secret")),
+		ttl:        v.GetDuration("handshake.ttl") * time.Second,
+		template:   defaultHandshakeTemplate,
+	}
+
+	if v.GetString("handshake.template") != "" {
+		handshakeTemplate, err := template.ParseFiles(v.GetString("handshake.template"))
+		if err != nil {
+			return nil, err
+		}
+		config.template = handshakeTemplate
+	}
+
+	return &config, nil
+}
+
+func validateHandshakeConfig(v *viper.Viper) error {
+	if !v.GetBool("handshake.enabled") {
+		return nil
+	}
+
+	if v.GetString("handshake.secret") == "" {
+		return errors.New("Missing `handshake.secret` option")
+	}
+
+	mode := v.GetString("handshake.mode")
+	if mode != "" && mode != handshakeModeRedirect && mode != handshakeModePage {
+		return errors.New("Option `handshake.mode` must be `redirect` or `page`")
+	}
+
+	if v.IsSet("handshake.ttl") && v.GetInt("handshake.ttl") <= 0 {
+		return errors.New("Option `handshake.ttl` must be greater than 0")
+	}
+
+	return nil
+}
+
+// completed tells whether the request carries a valid pre-session cookie
+// which has not created a session yet.
+func (config *handshakeConfig) completed(r *http.Request, usage *challengeUsage) bool {
+	if !config.enabled {
+		return true
+	}
+
+	nonce, _, ok := config.verify(r)
+
+	return ok && !usage.used(nonce)
+}
+
+// verify checks the pre-session cookie and returns it with its expiration,
+// the cookie is used as a nonce so that it creates a single session.
+func (config *handshakeConfig) verify(r *http.Request) (string, time.Time, bool) {
+	cookie, err := r.Cookie(config.cookieName)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	value, ok := verifySignedValue(config.secret, cookie.Value)
+	if !ok {
+		return "", time.Time{}, false
+	}
+
+	fields := strings.Split(value, "-")
+	if len(fields) != 2 {
+		return "", time.Time{}, false
+	}
+
+	expires, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", time.Time{}, false
+	}
+
+	return cookie.Value, time.Unix(expires, 0), true
+}
+
+// serve sets the pre-session cookie and sends the client back to the
+// requested URL, with a redirect or a page depending on the mode.
+func (config *handshakeConfig) serve(rw http.ResponseWriter, r *http.Request) {
+	expires := time.Now().Add(config.ttl)
+	http.SetCookie(rw, &http.Cookie{
+		Name:     config.cookieName,
+		Path:     "/",
+		Value:    signValue(config.secret, strconv.FormatInt(expires.Unix(), 10)+"-"+xid.New().String()),
+		Expires:  expires,
+		HttpOnly: true,
+	})
+	rw.Header().Set("Cache-Control", "no-store")
+
+	if config.mode == handshakeModePage {
+		config.template.Execute(rw, struct{ URL string }{URL: r.URL.RequestURI()})
+		return
+	}
+
+	http.Redirect(rw, r, r.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
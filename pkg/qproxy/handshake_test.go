@@ -0,0 +1,69 @@
+package qproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshake(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("handshake.enabled", true)
+	assert.EqualError(t, ValidateProxyConfig(v), "Missing `handshake.secret` option")
+
+	v.Set("handshake.secret", "secret")
+	require.NoError(t, ValidateProxyConfig(v))
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	handler := newProxyHandler(qp)
+	_, _, ok := qp.defaultRoom().defaultPool().syncNewSession("", nil, defaultLaneName, false)
+	require.True(t, ok)
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/shop?page=2", nil))
+	assert.Equal(t, http.StatusTemporaryRedirect, rw.Code)
+	assert.Equal(t, "/shop?page=2", rw.Header().Get("Location"))
+	assert.Equal(t, 0, qp.defaultRoom().defaultPool().syncStatistics().QueuedSessions)
+
+	cookies := rw.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "qpid_handshake", cookies[0].Name)
+
+	r := httptest.NewRequest("GET", "/shop?page=2", nil)
+	r.AddCookie(&http.Cookie{Name: cookies[0].Name, Value: cookies[0].Value + "x"})
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	assert.Equal(t, http.StatusTemporaryRedirect, rw.Code)
+
+	r = httptest.NewRequest("GET", "/shop?page=2", nil)
+	r.AddCookie(cookies[0])
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, 1, qp.defaultRoom().defaultPool().syncStatistics().QueuedSessions)
+
+	r = httptest.NewRequest("GET", "/shop?page=2", nil)
+	r.AddCookie(cookies[0])
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	assert.Equal(t, http.StatusTemporaryRedirect, rw.Code)
+	assert.Equal(t, 1, qp.defaultRoom().defaultPool().syncStatistics().QueuedSessions)
+
+	v.Set("handshake.mode", "page")
+	require.NoError(t, qp.config.loadDynamicConfig())
+	require.NoError(t, qp.loadRooms())
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/shop?page=2", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), `url=/shop?page=2`)
+
+	v.Set("handshake.mode", "other")
+	assert.EqualError(t, ValidateProxyConfig(v), "Option `handshake.mode` must be `redirect` or `page`")
+}
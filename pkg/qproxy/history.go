@@ -0,0 +1,184 @@
+package qproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type historyConfig struct {
+	size int
+	file string
+}
+
+func newHistoryConfig(v *viper.Viper) *historyConfig {
+	v.SetDefault("history.size", 720)
+
+	return &historyConfig{
+		size: v.GetInt("history.size"),
+		file: v.GetString("history.file"),
+	}
+}
+
+func validateHistoryConfig(v *viper.Viper) error {
+	if v.GetInt("history.size") < 0 {
+		return errors.New("Option `history.size` must be greater or equals than 0")
+	}
+
+	return nil
+}
+
+// HistorySample stores the statistics of the proxy at a refresh tick
+type HistorySample struct {
+	Time       time.Time
+	Statistics *ProxyStatistics
+}
+
+// history keeps the latest statistics samples in a ring buffer, samples are
+// appended as NDJSON to a file when one is configured.
+type history struct {
+	lock    sync.RWMutex
+	config  *historyConfig
+	samples []*HistorySample
+	next    int
+	file    *rotatingFile
+}
+
+func newHistory() *history {
+	return &history{config: &historyConfig{}}
+}
+
+// configure applies a new configuration, the latest samples are kept when the
+// size changes and the file is opened again when its path changes.
+func (h *history) configure(config *historyConfig) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.file != nil && h.file.path != config.file {
+		h.file.close()
+		h.file = nil
+	}
+
+	if h.file == nil && config.file != "" {
+		file, err := openRotatingFile(config.file)
+		if err != nil {
+			return err
+		}
+		h.file = file
+	}
+
+	if config.size != h.config.size {
+		samples := h.ordered()
+		if len(samples) > config.size {
+			samples = samples[len(samples)-config.size:]
+		}
+		h.samples = samples
+		h.next = 0
+	}
+	h.config = config
+
+	return nil
+}
+
+// reopen opens the file again, after it has been moved by an external tool.
+func (h *history) reopen() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.file == nil {
+		return nil
+	}
+
+	return h.file.reopen()
+}
+
+func (h *history) enabled() bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return h.config.size > 0 || h.file != nil
+}
+
+func (h *history) record(statistics *ProxyStatistics) error {
+	sample := &HistorySample{Time: time.Now(), Statistics: statistics}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.config.size > 0 {
+		if len(h.samples) < h.config.size {
+			h.samples = append(h.samples, sample)
+		} else {
+			h.samples[h.next] = sample
+			h.next = (h.next + 1) % h.config.size
+		}
+	}
+
+	if h.file == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+
+	return h.file.write(append(line, '\n'))
+}
+
+// ordered returns the samples from the oldest to the latest.
+func (h *history) ordered() []*HistorySample {
+	samples := make([]*HistorySample, 0, len(h.samples))
+	samples = append(samples, h.samples[h.next:]...)
+
+	return append(samples, h.samples[:h.next]...)
+}
+
+// since returns the samples taken after the given time, from the oldest to
+// the latest.
+func (h *history) since(t time.Time) []*HistorySample {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	samples := make([]*HistorySample, 0)
+	for _, sample := range h.ordered() {
+		if sample.Time.After(t) {
+			samples = append(samples, sample)
+		}
+	}
+
+	return samples
+}
+
+// parseHistorySince parses the `since` parameter of the history endpoint, an
+// RFC 3339 time or a duration before now.
+func parseHistorySince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, errors.New("Parameter `since` must be a RFC 3339 time or a duration")
+	}
+
+	return time.Now().Add(-d), nil
+}
+
+func (h *history) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	since, err := parseHistorySince(r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(rw, h.since(since))
+}
@@ -0,0 +1,86 @@
+package qproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "history.ndjson")
+
+	v := newViper()
+	v.Set("backends.test.url", "http://127.0.0.1")
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("history.size", 2)
+	v.Set("history.file", file)
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		qp.recordHistory()
+	}
+
+	samples := qp.history.since(time.Time{})
+	require.Len(t, samples, 2)
+	assert.True(t, samples[0].Time.Before(samples[1].Time))
+
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		sample := HistorySample{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &sample))
+		lines++
+	}
+	assert.Equal(t, 3, lines)
+
+	rw := httptest.NewRecorder()
+	newAPIHandler(qp).ServeHTTP(rw, httptest.NewRequest("GET", "/statistics/history?since="+samples[0].Time.Add(-time.Nanosecond).Format(time.RFC3339Nano), nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	served := make([]*HistorySample, 0)
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &served))
+	assert.Len(t, served, 2)
+
+	rw = httptest.NewRecorder()
+	newAPIHandler(qp).ServeHTTP(rw, httptest.NewRequest("GET", "/statistics/history?since=1h", nil))
+	served = make([]*HistorySample, 0)
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &served))
+	assert.Len(t, served, 2)
+
+	rw = httptest.NewRecorder()
+	newAPIHandler(qp).ServeHTTP(rw, httptest.NewRequest("GET", "/statistics/history?since=yesterday", nil))
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestHistoryResize(t *testing.T) {
+	h := newHistory()
+	require.NoError(t, h.configure(&historyConfig{size: 3}))
+	for i := 0; i < 5; i++ {
+		h.record(&ProxyStatistics{Uptime: string('a' + rune(i))})
+	}
+
+	require.NoError(t, h.configure(&historyConfig{size: 2}))
+	samples := h.since(time.Time{})
+	require.Len(t, samples, 2)
+	assert.Equal(t, "d", samples[0].Statistics.Uptime)
+	assert.Equal(t, "e", samples[1].Statistics.Uptime)
+}
@@ -0,0 +1,182 @@
+package qproxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// InvitationStatistics stores invitation codes usage and reservations
+type InvitationStatistics struct {
+	Codes                 []*InvitationCodeStatistics
+	ReservedSessions      int
+	RemainingReservations int
+}
+
+// InvitationCodeStatistics stores the usage of an invitation code, codes are
+// identified by the start of their SHA-256 hash as they grant admission.
+type InvitationCodeStatistics struct {
+	ID      string
+	Uses    int
+	MaxUses int
+}
+
+type invitationsConfig struct {
+	codes         map[string]int
+	param         string
+	reservedShare float64
+}
+
+func newInvitationsConfig(v *viper.Viper) (*invitationsConfig, error) {
+	v.SetDefault("invitations.param", "qp_invite")
+
+	config := invitationsConfig{
+		codes:         make(map[string]int),
+		param:         v.GetString("invitations.param"),
+		reservedShare: v.GetFloat64("invitations.reserved_share"),
+	}
+
+	if file := v.GetString("invitations.file"); file != "" {
+		codes, err := loadInvitationCodes(file)
+		if err != nil {
+			return nil, err
+		}
+		config.codes = codes
+	}
+
+	return &config, nil
+}
+
+func validateInvitationsConfig(v *viper.Viper) error {
+	share := v.GetFloat64("invitations.reserved_share")
+	if share < 0 || share >= 1 {
+		return errors.New("Option `invitations.reserved_share` must be greater or equals than 0 and less than 1")
+	}
+
+	if share > 0 && v.GetString("invitations.file") == "" {
+		return errors.New("Option `invitations.reserved_share` requires `invitations.file`")
+	}
+
+	return nil
+}
+
+// loadInvitationCodes reads a file holding one code per line, optionally
+// followed by its maximum number of uses. Empty lines and lines starting with
+// `#` are ignored.
+func loadInvitationCodes(file string) (map[string]int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	codes := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		maxUses := 0
+		if len(fields) > 1 {
+			maxUses, err = strconv.Atoi(fields[1])
+			if err != nil || maxUses < 0 {
+				return nil, errors.New("Invalid maximum uses on line " + strconv.Itoa(lineNumber) + " of " + file)
+			}
+		}
+
+		codes[fields[0]] = maxUses
+	}
+
+	return codes, scanner.Err()
+}
+
+// extractInvitationCode removes the invitation code from the request query, so
+// it is not forwarded to the backend, and returns it.
+func (config *invitationsConfig) extractInvitationCode(r *http.Request) (string, bool) {
+	if len(config.codes) == 0 {
+		return "", false
+	}
+
+	rawQuery, code := removeQueryParam(r.URL.RawQuery, config.param)
+	if code == "" {
+		return "", false
+	}
+
+	r.URL.RawQuery = rawQuery
+	r.RequestURI = r.URL.RequestURI()
+	accessLogEntryFromContext(r.Context()).setURI(r.RequestURI)
+
+	return code, true
+}
+
+// invitationUsage counts the admissions of each invitation code, it survives
+// configuration reloads.
+type invitationUsage struct {
+	lock sync.Mutex
+	uses map[string]int
+}
+
+func newInvitationUsage() *invitationUsage {
+	return &invitationUsage{uses: make(map[string]int)}
+}
+
+// use records an admission, it fails when the code is unknown or has been used
+// too many times.
+func (u *invitationUsage) use(config *invitationsConfig, code string) bool {
+	maxUses, ok := config.codes[code]
+	if !ok {
+		return false
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if maxUses > 0 && u.uses[code] >= maxUses {
+		return false
+	}
+	u.uses[code]++
+
+	return true
+}
+
+// release cancels an admission which could not be completed.
+func (u *invitationUsage) release(code string) {
+	u.lock.Lock()
+	if u.uses[code] > 0 {
+		u.uses[code]--
+	}
+	u.lock.Unlock()
+}
+
+func (u *invitationUsage) statistics(config *invitationsConfig) []*InvitationCodeStatistics {
+	u.lock.Lock()
+	statistics := make([]*InvitationCodeStatistics, 0)
+	for code, maxUses := range config.codes {
+		statistics = append(statistics, &InvitationCodeStatistics{ID: invitationCodeID(code), Uses: u.uses[code], MaxUses: maxUses})
+	}
+	u.lock.Unlock()
+
+	sort.Slice(statistics, func(i int, j int) bool {
+		return statistics[i].ID < statistics[j].ID
+	})
+
+	return statistics
+}
+
+// invitationCodeID returns the first 12 hexadecimal characters of the SHA-256
+// hash of the code.
+func invitationCodeID(code string) string {
+	sum := sha256.Sum256([]byte(code))
+
+	return hex.EncodeToString(sum[:6])
+}
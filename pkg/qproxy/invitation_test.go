@@ -0,0 +1,113 @@
+package qproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadInvitationCodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "codes.txt")
+	require.NoError(t, ioutil.WriteFile(file, []byte("# partners\nVIP\nPRESS 2\n\n"), 0600))
+	codes, err := loadInvitationCodes(file)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"VIP": 0, "PRESS": 2}, codes)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("PRESS two\n"), 0600))
+	_, err = loadInvitationCodes(file)
+	assert.EqualError(t, err, "Invalid maximum uses on line 1 of "+file)
+
+	config := &invitationsConfig{codes: map[string]int{"PRESS": 1}, param: "qp_invite"}
+	r := httptest.NewRequest("GET", "/?qp_invite=PRESS&page=2", nil)
+	code, ok := config.extractInvitationCode(r)
+	assert.True(t, ok)
+	assert.Equal(t, "PRESS", code)
+	assert.Equal(t, "/?page=2", r.RequestURI)
+
+	r = httptest.NewRequest("GET", "/?z=%7E&qp_invite=PRESS&a=1&z=2", nil)
+	_, ok = config.extractInvitationCode(r)
+	assert.True(t, ok)
+	assert.Equal(t, "/?z=%7E&a=1&z=2", r.RequestURI)
+
+	usage := newInvitationUsage()
+	assert.True(t, usage.use(config, "PRESS"))
+	assert.False(t, usage.use(config, "PRESS"))
+	assert.False(t, usage.use(config, "OTHER"))
+	usage.release("PRESS")
+	assert.True(t, usage.use(config, "PRESS"))
+}
+
+func TestInvitationReservedSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "codes.txt")
+	require.NoError(t, ioutil.WriteFile(file, []byte("VIP 1\n"), 0600))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	v := newViper()
+	v.Set("backends.test.url", upstream.URL)
+	v.Set("backends.test.max_sessions", 2)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("invitations.file", file)
+	v.Set("invitations.reserved_share", 0.5)
+	require.NoError(t, ValidateProxyConfig(v))
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	pool := qp.defaultRoom().defaultPool()
+
+	_, _, ok := pool.syncNewSession("", nil, defaultLaneName, false)
+	require.True(t, ok)
+	_, backend, ok := pool.syncNewSession("", nil, defaultLaneName, false)
+	require.True(t, ok)
+	assert.Nil(t, backend)
+
+	rw := httptest.NewRecorder()
+	newProxyHandler(qp).ServeHTTP(rw, httptest.NewRequest("GET", "/?qp_invite=VIP", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Len(t, rw.Result().Cookies(), 1)
+
+	statistics := qp.defaultRoom().syncInvitationStatistics()
+	assert.Equal(t, 1, statistics.ReservedSessions)
+	assert.Equal(t, 0, statistics.RemainingReservations)
+	assert.Equal(t, 1, statistics.Codes[0].Uses)
+	assert.Equal(t, invitationCodeID("VIP"), statistics.Codes[0].ID)
+	assert.Len(t, statistics.Codes[0].ID, 12)
+
+	rw = httptest.NewRecorder()
+	newAPIHandler(qp).ServeHTTP(rw, httptest.NewRequest("GET", "/invitations", nil))
+	assert.NotContains(t, rw.Body.String(), "VIP")
+
+	output := &bytes.Buffer{}
+	logger := componentLoggers[logComponentSessions]
+	defer logger.SetOutput(logger.Out)
+	logger.SetOutput(output)
+	newProxyHandler(qp).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?qp_invite=VIP", nil))
+	assert.Contains(t, output.String(), "Invitation code rejected")
+	assert.Contains(t, output.String(), invitationCodeID("VIP"))
+	assert.NotContains(t, output.String(), "VIP")
+
+	v.Set("invitations.reserved_share", 1)
+	assert.EqualError(t, ValidateProxyConfig(v), "Option `invitations.reserved_share` must be greater or equals than 0 and less than 1")
+
+	v.Set("invitations.reserved_share", 0.5)
+	v.Set("invitations.file", "")
+	assert.EqualError(t, ValidateProxyConfig(v), "Option `invitations.reserved_share` requires `invitations.file`")
+}
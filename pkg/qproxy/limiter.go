@@ -0,0 +1,100 @@
+package qproxy
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+type limiterWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// requestLimiter limits the number of in-flight requests, requests above the
+// limit wait in a bounded FIFO queue until a slot is released.
+type requestLimiter struct {
+	lock        sync.Mutex
+	maxInFlight int
+	maxWaiting  int
+	inFlight    int
+	waiting     *list.List
+}
+
+func newRequestLimiter() *requestLimiter {
+	return &requestLimiter{waiting: list.New()}
+}
+
+// setLimits updates the limits, set maxInFlight to 0 to disable the limit.
+func (l *requestLimiter) setLimits(maxInFlight int, maxWaiting int) {
+	l.lock.Lock()
+	l.maxInFlight = maxInFlight
+	l.maxWaiting = maxWaiting
+	for l.waiting.Len() > 0 && (l.maxInFlight == 0 || l.inFlight < l.maxInFlight) {
+		l.inFlight++
+		l.grant(l.waiting.Front())
+	}
+	l.lock.Unlock()
+}
+
+// acquire reserves a slot, waiting at most timeout for one to be released.
+func (l *requestLimiter) acquire(ctx context.Context, timeout time.Duration) bool {
+	l.lock.Lock()
+	if l.maxInFlight == 0 || l.inFlight < l.maxInFlight {
+		l.inFlight++
+		l.lock.Unlock()
+		return true
+	}
+
+	if l.waiting.Len() >= l.maxWaiting {
+		l.lock.Unlock()
+		return false
+	}
+
+	waiter := &limiterWaiter{ready: make(chan struct{})}
+	element := l.waiting.PushBack(waiter)
+	l.lock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-waiter.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if waiter.granted {
+		// The slot has been granted while timing out
+		return true
+	}
+	l.waiting.Remove(element)
+
+	return false
+}
+
+func (l *requestLimiter) release() {
+	l.lock.Lock()
+	if front := l.waiting.Front(); front != nil && (l.maxInFlight == 0 || l.inFlight <= l.maxInFlight) {
+		l.grant(front)
+	} else {
+		l.inFlight--
+	}
+	l.lock.Unlock()
+}
+
+func (l *requestLimiter) grant(element *list.Element) {
+	waiter := l.waiting.Remove(element).(*limiterWaiter)
+	waiter.granted = true
+	close(waiter.ready)
+}
+
+func (l *requestLimiter) counts() (int, int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.inFlight, l.waiting.Len()
+}
@@ -0,0 +1,40 @@
+package qproxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	l := newRequestLimiter()
+	assert.True(t, l.acquire(context.Background(), 0))
+	l.release()
+
+	l.setLimits(1, 1)
+	assert.True(t, l.acquire(context.Background(), 0))
+	assert.False(t, l.acquire(context.Background(), time.Millisecond))
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- l.acquire(context.Background(), time.Second)
+	}()
+	for _, waiting := l.counts(); waiting == 0; _, waiting = l.counts() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full
+	assert.False(t, l.acquire(context.Background(), time.Second))
+
+	l.release()
+	assert.True(t, <-acquired)
+	inFlight, waiting := l.counts()
+	assert.Equal(t, 1, inFlight)
+	assert.Equal(t, 0, waiting)
+
+	l.release()
+	inFlight, _ = l.counts()
+	assert.Equal(t, 0, inFlight)
+}
@@ -0,0 +1,220 @@
+package qproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
+	"github.com/spf13/viper"
+)
+
+const (
+	logComponentProxy    = "proxy"
+	logComponentAPI      = "api"
+	logComponentSessions = "sessions"
+	logComponentConfig   = "config"
+
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	logOutputStdout = "stdout"
+	logOutputStderr = "stderr"
+	logOutputFile   = "file"
+	logOutputSyslog = "syslog"
+)
+
+// componentLoggers have their own level, they share the output and the format
+// of the standard logger.
+var componentLoggers = map[string]*log.Logger{
+	logComponentProxy:    log.New(),
+	logComponentAPI:      log.New(),
+	logComponentSessions: log.New(),
+	logComponentConfig:   log.New(),
+}
+
+var (
+	proxyLog    = componentLoggers[logComponentProxy].WithField("component", logComponentProxy)
+	apiLog      = componentLoggers[logComponentAPI].WithField("component", logComponentAPI)
+	sessionsLog = componentLoggers[logComponentSessions].WithField("component", logComponentSessions)
+	configLog   = componentLoggers[logComponentConfig].WithField("component", logComponentConfig)
+)
+
+type loggingConfig struct {
+	level     log.Level
+	levels    map[string]log.Level
+	format    string
+	output    string
+	file      string
+	syslogTag string
+}
+
+func newLoggingConfig(v *viper.Viper) (*loggingConfig, error) {
+	v.SetDefault("log.level", "info")
+	v.SetDefault("log.format", logFormatText)
+	v.SetDefault("log.output", logOutputStderr)
+	v.SetDefault("log.syslog_tag", "qproxy")
+
+	level, err := log.ParseLevel(v.GetString("log.level"))
+	if err != nil {
+		return nil, errors.New("Option `log.level` must be a valid level")
+	}
+
+	config := loggingConfig{
+		level:     level,
+		levels:    make(map[string]log.Level),
+		format:    v.GetString("log.format"),
+		output:    v.GetString("log.output"),
+		file:      v.GetString("log.file"),
+		syslogTag: v.GetString("log.syslog_tag"),
+	}
+
+	for component, rawLevel := range v.GetStringMapString("log.levels") {
+		if _, ok := componentLoggers[component]; !ok {
+			return nil, fmt.Errorf("Unknown log component `%s`", component)
+		}
+
+		if config.levels[component], err = log.ParseLevel(rawLevel); err != nil {
+			return nil, fmt.Errorf("Option `log.levels.%s` must be a valid level", component)
+		}
+	}
+
+	if config.format != logFormatText && config.format != logFormatJSON {
+		return nil, errors.New("Option `log.format` must be `text` or `json`")
+	}
+
+	switch config.output {
+	case logOutputStdout, logOutputStderr, logOutputSyslog:
+	case logOutputFile:
+		if config.file == "" {
+			return nil, errors.New("Missing `log.file` option")
+		}
+	default:
+		return nil, errors.New("Option `log.output` must be `stdout`, `stderr`, `file` or `syslog`")
+	}
+
+	return &config, nil
+}
+
+func validateLoggingConfig(v *viper.Viper) error {
+	_, err := newLoggingConfig(v)
+
+	return err
+}
+
+// logging holds the output shared by the loggers, it is replaced when the
+// output options change.
+var logging struct {
+	lock   sync.Mutex
+	config *loggingConfig
+	closer io.Closer
+}
+
+// configureLogging applies the logging configuration to the standard and the
+// component loggers.
+func configureLogging(config *loggingConfig) error {
+	logging.lock.Lock()
+	defer logging.lock.Unlock()
+
+	var formatter log.Formatter = &log.TextFormatter{}
+	if config.format == logFormatJSON {
+		formatter = &log.JSONFormatter{}
+	}
+
+	previous := logging.config
+	outputChanged := previous == nil || previous.output != config.output ||
+		previous.file != config.file || previous.syslogTag != config.syslogTag
+
+	var out io.Writer
+	var closer io.Closer
+	hooks := make(log.LevelHooks)
+	if outputChanged {
+		switch config.output {
+		case logOutputStdout:
+			out = os.Stdout
+		case logOutputStderr:
+			out = os.Stderr
+		case logOutputFile:
+			file, err := os.OpenFile(config.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			out, closer = file, file
+		case logOutputSyslog:
+			hook, err := logrus_syslog.NewSyslogHook("", "", syslog.LOG_INFO|syslog.LOG_DAEMON, config.syslogTag)
+			if err != nil {
+				return err
+			}
+			out, closer = ioutil.Discard, hook.Writer
+			hooks.Add(hook)
+		}
+	}
+
+	for _, logger := range allLoggers() {
+		logger.SetFormatter(formatter)
+		if outputChanged {
+			logger.SetOutput(out)
+			logger.ReplaceHooks(hooks)
+		}
+	}
+
+	log.SetLevel(config.level)
+	for component, logger := range componentLoggers {
+		level, ok := config.levels[component]
+		if !ok {
+			level = config.level
+		}
+		logger.SetLevel(level)
+	}
+
+	if outputChanged && logging.closer != nil {
+		logging.closer.Close()
+	}
+	if outputChanged {
+		logging.closer = closer
+	}
+	logging.config = config
+
+	return nil
+}
+
+// reopenLogging reopens the log file, so that it can be rotated by an external
+// tool, other outputs are left untouched.
+func reopenLogging() error {
+	logging.lock.Lock()
+	defer logging.lock.Unlock()
+
+	if logging.config == nil || logging.config.output != logOutputFile {
+		return nil
+	}
+
+	file, err := os.OpenFile(logging.config.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	for _, logger := range allLoggers() {
+		logger.SetOutput(file)
+	}
+
+	if logging.closer != nil {
+		logging.closer.Close()
+	}
+	logging.closer = file
+
+	return nil
+}
+
+func allLoggers() []*log.Logger {
+	loggers := []*log.Logger{log.StandardLogger()}
+	for _, logger := range componentLoggers {
+		loggers = append(loggers, logger)
+	}
+
+	return loggers
+}
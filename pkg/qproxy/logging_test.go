@@ -0,0 +1,82 @@
+package qproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggingConfig(t *testing.T) {
+	v := newViper()
+	v.Set("log.levels.sessions", "debug")
+	config, err := newLoggingConfig(v)
+	require.NoError(t, err)
+	assert.Equal(t, log.InfoLevel, config.level)
+	assert.Equal(t, log.DebugLevel, config.levels[logComponentSessions])
+
+	for key, value := range map[string]string{
+		"log.level":        "verbose",
+		"log.levels.other": "debug",
+		"log.format":       "xml",
+		"log.output":       "file",
+	} {
+		v := newViper()
+		v.Set(key, value)
+		assert.Error(t, validateLoggingConfig(v), key)
+	}
+}
+
+func TestConfigureLogging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer configureLogging(&loggingConfig{level: log.InfoLevel, format: logFormatText, output: logOutputStderr})
+
+	path := filepath.Join(dir, "qproxy.log")
+	require.NoError(t, configureLogging(&loggingConfig{
+		level:  log.InfoLevel,
+		levels: map[string]log.Level{logComponentSessions: log.DebugLevel},
+		format: logFormatJSON,
+		output: logOutputFile,
+		file:   path,
+	}))
+
+	sessionsLog.Debug("sessions debug")
+	proxyLog.Debug("proxy debug")
+	proxyLog.Info("proxy info")
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"component":"sessions","level":"debug","msg":"sessions debug"`)
+	assert.NotContains(t, string(b), "proxy debug")
+	assert.Contains(t, string(b), `"msg":"proxy info"`)
+}
+
+func TestReopenLogging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer configureLogging(&loggingConfig{level: log.InfoLevel, format: logFormatText, output: logOutputStderr})
+
+	path := filepath.Join(dir, "qproxy.log")
+	require.NoError(t, configureLogging(&loggingConfig{level: log.InfoLevel, format: logFormatText, output: logOutputFile, file: path}))
+	proxyLog.Info("before rotation")
+
+	require.NoError(t, os.Rename(path, path+".1"))
+	require.NoError(t, reopenLogging())
+	proxyLog.Info("after rotation")
+
+	b, err := ioutil.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "before rotation")
+	assert.NotContains(t, string(b), "after rotation")
+
+	b, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "after rotation")
+}
@@ -0,0 +1,159 @@
+package qproxy
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus metrics of a QProxy, served on the api
+// `/metrics` endpoint.
+type metrics struct {
+	registry        *prometheus.Registry
+	admissions      *prometheus.CounterVec
+	expirations     *prometheus.CounterVec
+	queueFull       *prometheus.CounterVec
+	abandonments    *prometheus.CounterVec
+	queueWait       *prometheus.HistogramVec
+	requestDuration *prometheus.HistogramVec
+}
+
+func newMetrics(qp *QProxy) *metrics {
+	m := metrics{
+		registry: prometheus.NewRegistry(),
+		admissions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qproxy_admissions_total",
+			Help: "Sessions admitted on a backend, directly or from the queue.",
+		}, []string{"room", "pool"}),
+		expirations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qproxy_session_expirations_total",
+			Help: "Sessions removed after their TTL, by state.",
+		}, []string{"room", "pool", "state"}),
+		queueFull: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qproxy_queue_full_rejections_total",
+			Help: "Clients served the full template because the queue is full.",
+		}, []string{"room", "pool"}),
+		abandonments: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qproxy_queue_abandonments_total",
+			Help: "Queued sessions which expired before their admission, by lane.",
+		}, []string{"room", "pool", "lane"}),
+		queueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "qproxy_queue_wait_seconds",
+			Help:    "Time spent in the queue by sessions admitted from the queue, by lane.",
+			Buckets: queueWaitBuckets,
+		}, []string{"room", "pool", "lane"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "qproxy_request_duration_seconds",
+			Help:    "Latency of the requests proxied to the backends.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"room", "pool", "backend", "code"}),
+	}
+
+	m.registry.MustRegister(
+		m.admissions,
+		m.expirations,
+		m.queueFull,
+		m.abandonments,
+		m.queueWait,
+		m.requestDuration,
+		newStatisticsCollector(qp),
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	return &m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// poolMetrics are the metrics of a pool, with the room and pool labels set.
+type poolMetrics struct {
+	admissions          prometheus.Counter
+	queuedExpirations   prometheus.Counter
+	admittedExpirations prometheus.Counter
+	queueFull           prometheus.Counter
+	abandonments        *prometheus.CounterVec
+	queueWait           prometheus.ObserverVec
+	requestDuration     prometheus.ObserverVec
+}
+
+func (m *metrics) forPool(roomName string, poolName string) *poolMetrics {
+	labels := prometheus.Labels{"room": roomName, "pool": poolName}
+
+	return &poolMetrics{
+		admissions:          m.admissions.With(labels),
+		queuedExpirations:   m.expirations.WithLabelValues(roomName, poolName, "queued"),
+		admittedExpirations: m.expirations.WithLabelValues(roomName, poolName, "admitted"),
+		queueFull:           m.queueFull.With(labels),
+		abandonments:        m.abandonments.MustCurryWith(labels),
+		queueWait:           m.queueWait.MustCurryWith(labels),
+		requestDuration:     m.requestDuration.MustCurryWith(labels),
+	}
+}
+
+// statisticsCollector exports the sessions and capacity gauges from the rooms
+// statistics when metrics are gathered.
+type statisticsCollector struct {
+	qp                  *QProxy
+	queuedSessions      *prometheus.Desc
+	maxQueuedSessions   *prometheus.Desc
+	admittedSessions    *prometheus.Desc
+	maxSessions         *prometheus.Desc
+	inFlightRequests    *prometheus.Desc
+	whitelistedRequests *prometheus.Desc
+	bypassedRequests    *prometheus.Desc
+}
+
+func newStatisticsCollector(qp *QProxy) *statisticsCollector {
+	return &statisticsCollector{
+		qp: qp,
+		queuedSessions: prometheus.NewDesc("qproxy_queued_sessions",
+			"Sessions waiting in the queue, by lane.", []string{"room", "pool", "lane"}, nil),
+		maxQueuedSessions: prometheus.NewDesc("qproxy_max_queued_sessions",
+			"Maximum queued sessions, 0 when unlimited.", []string{"room", "pool"}, nil),
+		admittedSessions: prometheus.NewDesc("qproxy_admitted_sessions",
+			"Sessions admitted on a backend.", []string{"room", "pool", "backend"}, nil),
+		maxSessions: prometheus.NewDesc("qproxy_backend_max_sessions",
+			"Maximum sessions of a backend.", []string{"room", "pool", "backend"}, nil),
+		inFlightRequests: prometheus.NewDesc("qproxy_backend_in_flight_requests",
+			"Requests being proxied to a backend.", []string{"room", "pool", "backend"}, nil),
+		whitelistedRequests: prometheus.NewDesc("qproxy_backend_whitelisted_requests_total",
+			"Whitelisted requests proxied to a backend.", []string{"room", "pool", "backend"}, nil),
+		bypassedRequests: prometheus.NewDesc("qproxy_backend_bypassed_requests_total",
+			"Requests bypassing the queue proxied to a backend.", []string{"room", "pool", "backend"}, nil),
+	}
+}
+
+func (c *statisticsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.queuedSessions
+	ch <- c.maxQueuedSessions
+	ch <- c.admittedSessions
+	ch <- c.maxSessions
+	ch <- c.inFlightRequests
+	ch <- c.whitelistedRequests
+	ch <- c.bypassedRequests
+}
+
+func (c *statisticsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, room := range c.qp.rooms() {
+		for _, pool := range room.pools() {
+			statistics := pool.syncStatistics()
+			for lane, queued := range statistics.QueuedLanes {
+				ch <- prometheus.MustNewConstMetric(c.queuedSessions, prometheus.GaugeValue, float64(queued), room.name, pool.name, lane)
+			}
+			ch <- prometheus.MustNewConstMetric(c.maxQueuedSessions, prometheus.GaugeValue, float64(statistics.MaxQueuedSessions), room.name, pool.name)
+
+			for _, backend := range statistics.Backends {
+				labels := []string{room.name, pool.name, backend.Name}
+				ch <- prometheus.MustNewConstMetric(c.admittedSessions, prometheus.GaugeValue, float64(backend.Sessions), labels...)
+				ch <- prometheus.MustNewConstMetric(c.maxSessions, prometheus.GaugeValue, float64(backend.MaxSessions), labels...)
+				ch <- prometheus.MustNewConstMetric(c.inFlightRequests, prometheus.GaugeValue, float64(backend.InFlightRequests), labels...)
+				ch <- prometheus.MustNewConstMetric(c.whitelistedRequests, prometheus.CounterValue, float64(backend.WhitelistedRequests), labels...)
+				ch <- prometheus.MustNewConstMetric(c.bypassedRequests, prometheus.CounterValue, float64(backend.BypassedRequests), labels...)
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package qproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+
+	v := newViper()
+	v.Set("backends.test.url", upstream.URL)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("queue.max_sessions", 1)
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	handler := newProxyHandler(qp)
+
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	rw := httptest.NewRecorder()
+	newAPIHandler(qp).ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	body := rw.Body.String()
+	assert.Contains(t, body, `qproxy_admissions_total{pool="default",room="default"} 1`)
+	assert.Contains(t, body, `qproxy_queue_full_rejections_total{pool="default",room="default"} 1`)
+	assert.Contains(t, body, `qproxy_queued_sessions{lane="default",pool="default",room="default"} 1`)
+	assert.Contains(t, body, `qproxy_admitted_sessions{backend="test",pool="default",room="default"} 1`)
+	assert.Contains(t, body, `qproxy_backend_max_sessions{backend="test",pool="default",room="default"} 1`)
+	assert.Contains(t, body, `qproxy_request_duration_seconds_count{backend="test",code="201",pool="default",room="default"} 1`)
+	assert.Contains(t, body, "go_goroutines")
+}
+
+func TestMetricsDirectAdmissions(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 3)
+	v.Set("backends.test.session_ttl", 5)
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	pool := qp.defaultRoom().defaultPool()
+	pool.backends()[0].reservedSessions = 1
+
+	_, _, ok := pool.syncNewWhitelistedSession("", nil)
+	require.True(t, ok)
+	pool.syncNewAdmittedSession("", "", nil)
+	_, _, ok = pool.syncNewReservedSession("", nil)
+	require.True(t, ok)
+
+	assert.Equal(t, uint64(3), qp.syncStatistics().Backends[0].Traffic.Admissions)
+
+	rw := httptest.NewRecorder()
+	newAPIHandler(qp).ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rw.Body.String(), `qproxy_admissions_total{pool="default",room="default"} 3`)
+}
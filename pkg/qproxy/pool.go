@@ -0,0 +1,514 @@
+package qproxy
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/xid"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultPoolName = "default"
+
+// PoolStatistics stores pool statistics
+type PoolStatistics struct {
+	Name              string
+	QueuedSessions    int
+	MaxQueuedSessions int
+	QueuedSessionTTL  string
+	QueuedLanes       map[string]int
+	QueueWaitLanes    map[string]*QueueWaitStatistics
+	Backends          []*BackendStatistics
+
+	QueueFullRejections uint64
+
+	WhitelistedRequests uint64
+	BypassedRequests    uint64
+}
+
+// pool is a set of backends sharing a queue
+type pool struct {
+	queueFullRejections uint64
+	name                string
+	atomicConfig        atomic.Value
+	atomicBackends      atomic.Value
+	sessionsLock        sync.RWMutex
+	queuedSessions      *laneQueue
+	clients             clientIndex
+	queueWaits          queueWaitLanes
+	metrics             *poolMetrics
+	events              *poolEvents
+}
+
+func newPool(name string, metrics *poolMetrics, events *poolEvents) *pool {
+	p := pool{
+		name:           name,
+		metrics:        metrics,
+		events:         events,
+		queuedSessions: newLaneQueue(),
+		clients:        make(clientIndex),
+		queueWaits:     make(queueWaitLanes),
+	}
+	p.atomicBackends.Store(make([]*backend, 0))
+
+	return &p
+}
+
+// newBackends creates the backends described by the configuration, sessions of
+// the current backends with the same name are preserved.
+func (p *pool) newBackends(config *poolConfig) ([]*backend, error) {
+	oldBackends := p.backends()
+	newBackends := make([]*backend, 0)
+	for backendName, backendConfig := range config.backends {
+		var previous *backend
+		for _, oldBackend := range oldBackends {
+			if oldBackend.name == backendName {
+				previous = oldBackend
+				break
+			}
+		}
+
+		backend, err := newBackend(backendName, backendConfig, previous)
+		if err != nil {
+			return nil, err
+		}
+
+		newBackends = append(newBackends, backend)
+	}
+
+	return newBackends, nil
+}
+
+// update replaces the configuration and the backends of the pool.
+func (p *pool) update(config *poolConfig, backends []*backend) {
+	oldBackends := p.backends()
+	p.sessionsLock.Lock()
+	p.queuedSessions.setLanes(config.lanes)
+	p.sessionsLock.Unlock()
+
+	p.atomicConfig.Store(config)
+	p.atomicBackends.Store(backends)
+	for _, oldBackend := range oldBackends {
+		oldBackend.transport.CloseIdleConnections()
+	}
+}
+
+func (p *pool) config() *poolConfig {
+	return p.atomicConfig.Load().(*poolConfig)
+}
+
+func (p *pool) backends() []*backend {
+	return p.atomicBackends.Load().([]*backend)
+}
+
+func (p *pool) availableBackends() []*backend {
+	availableBackends := make([]*backend, 0)
+	for _, backend := range p.backends() {
+		if backend.remainingPlaces() > 0 {
+			availableBackends = append(availableBackends, backend)
+		}
+	}
+
+	return availableBackends
+}
+
+func (p *pool) backendByName(name string) (*backend, bool) {
+	for _, backend := range p.backends() {
+		if backend.name == name {
+			return backend, true
+		}
+	}
+
+	return nil, false
+}
+
+func (p *pool) syncHasRemainingQueueSlots() bool {
+	p.sessionsLock.RLock()
+	hasRemainingQueueSlots := p.hasRemainingQueueSlots()
+	p.sessionsLock.RUnlock()
+
+	return hasRemainingQueueSlots
+}
+
+func (p *pool) hasRemainingQueueSlots() bool {
+	maxQueuedSessions := p.config().maxQueuedSessions
+	if maxQueuedSessions <= 0 {
+		return true
+	}
+
+	return (maxQueuedSessions - p.queuedSessions.len()) > 0
+}
+
+// countQueueFull counts a client served the full template.
+func (p *pool) countQueueFull() {
+	atomic.AddUint64(&p.queueFullRejections, 1)
+	p.metrics.queueFull.Inc()
+}
+
+// syncRemoveSession removes a session, admitted or queued.
+func (p *pool) syncRemoveSession(id string) {
+	p.sessionsLock.Lock()
+	defer p.sessionsLock.Unlock()
+
+	for _, backend := range p.backends() {
+		if session, ok := backend.loadSession(id); ok && backend.removeSession(id) {
+			p.events.emit(eventSessionEvicted, session, backend)
+			return
+		}
+	}
+
+	if session, ok := p.queuedSessions.load(id); ok && p.queuedSessions.remove(id) {
+		p.events.emit(eventSessionEvicted, session, nil)
+	}
+}
+
+// syncQueuePressure returns the filling of the queue, between 0 and 1. The
+// queue size is the sum of the backends places when it is unlimited.
+func (p *pool) syncQueuePressure() float64 {
+	p.sessionsLock.RLock()
+	queued := p.queuedSessions.len()
+	p.sessionsLock.RUnlock()
+
+	capacity := p.config().maxQueuedSessions
+	if capacity <= 0 {
+		for _, backend := range p.backends() {
+			capacity += backend.maxSessions
+		}
+	}
+
+	if capacity <= 0 || queued >= capacity {
+		return 1
+	}
+
+	return float64(queued) / float64(capacity)
+}
+
+func (p *pool) loadSession(id string) (*session, *backend, bool) {
+	for _, backend := range p.backends() {
+		if session, ok := backend.loadSession(id); ok {
+			session.update(backend.sessionTTL)
+
+			return session, backend, true
+		}
+	}
+
+	if session, ok := p.queuedSessions.load(id); ok {
+		session.update(p.config().queuedSessionTTL)
+
+		return session, nil, true
+	}
+
+	return nil, nil, false
+}
+
+func (p *pool) syncLoadSession(id string) (*session, *backend, bool) {
+	p.sessionsLock.RLock()
+	session, backend, ok := p.loadSession(id)
+	p.sessionsLock.RUnlock()
+
+	return session, backend, ok
+}
+
+func (p *pool) syncHasRemainingClientQuota(client string) bool {
+	p.sessionsLock.RLock()
+	exceeds := p.clients.exceeds(p.config().quotas, client)
+	p.sessionsLock.RUnlock()
+
+	return !exceeds
+}
+
+// syncNewSession creates a session of the client in the given queue lane, the
+// session is admitted directly when the queue is empty unless forceQueue is
+// set. It fails when the queue is full or the client is over its quotas.
+func (p *pool) syncNewSession(client string, binding *sessionBinding, lane string, forceQueue bool) (*session, *backend, bool) {
+	p.sessionsLock.Lock()
+	defer p.sessionsLock.Unlock()
+
+	quotas := p.config().quotas
+	if p.clients.exceeds(quotas, client) {
+		return nil, nil, false
+	}
+
+	id := xid.New().String()
+
+	if p.queuedSessions.len() == 0 && !forceQueue {
+		for _, backend := range balance(p.availableBackends()) {
+			if session, ok := backend.storeSession(id); ok {
+				session.binding = binding
+				p.assignClient(session, client)
+				p.emitDirectAdmission(session, backend)
+				sessionsLog.WithFields(log.Fields{"pool": p.name, "session": id, "backend": backend.name}).Debug("Session admitted directly")
+				return session, backend, true
+			}
+		}
+	}
+
+	if !p.hasRemainingQueueSlots() {
+		return nil, nil, false
+	}
+
+	session := newSession(id, p.config().queuedSessionTTL)
+	session.lane = lane
+	session.binding = binding
+	if quotas.enabled() {
+		session.client = client
+		p.clients.counts(client).queued++
+	}
+
+	p.events.emit(eventSessionCreated, session, nil)
+	p.events.emit(eventSessionQueued, session, nil)
+	sessionsLog.WithFields(log.Fields{"pool": p.name, "session": id, "lane": lane}).Debug("Session queued")
+
+	return p.queuedSessions.store(session), nil, true
+}
+
+// indexClients rebuilds the client index from the session stores.
+func (p *pool) indexClients() {
+	p.clients = make(clientIndex)
+	if !p.config().quotas.enabled() {
+		return
+	}
+
+	for _, store := range p.queuedSessions.stores {
+		for _, s := range store.sessions {
+			if s.client != "" {
+				p.clients.counts(s.client).queued++
+			}
+		}
+	}
+
+	for _, backend := range p.backends() {
+		for _, store := range []*sessionStore{backend.sessionStore, backend.reservedStore} {
+			for _, s := range store.sessions {
+				if s.client != "" {
+					p.clients.counts(s.client).admitted++
+				}
+			}
+		}
+	}
+}
+
+// assignClient records the client of an admitted session in the quota index,
+// sessions admitted by token, invitation or whitelist are counted even though
+// they are not refused when the client is over quota.
+func (p *pool) assignClient(s *session, client string) {
+	if p.config().quotas.enabled() {
+		s.client = client
+		p.clients.counts(client).admitted++
+	}
+}
+
+func (p *pool) syncUpdateSessions() {
+	p.sessionsLock.Lock()
+	defer p.sessionsLock.Unlock()
+	defer p.indexClients()
+
+	freeSlots := 0
+	availableBackends := make([]*backend, 0)
+	expired := p.queuedSessions.removeExpired()
+	p.metrics.queuedExpirations.Add(float64(len(expired)))
+	for _, session := range expired {
+		p.observeAbandonment(session)
+	}
+	for _, backend := range p.backends() {
+		expired := backend.removeExpiredSessions()
+		p.metrics.admittedExpirations.Add(float64(len(expired)))
+		if len(expired) > 0 {
+			sessionsLog.WithFields(log.Fields{"pool": p.name, "backend": backend.name, "sessions": len(expired)}).Debug("Admitted sessions expired")
+		}
+		for _, session := range expired {
+			p.events.emitExpired(session, backend, "admitted", session.queueWait())
+		}
+		if remainingPlaces := backend.remainingPlaces(); remainingPlaces > 0 {
+			freeSlots += remainingPlaces
+			availableBackends = append(availableBackends, backend)
+		}
+	}
+
+	if freeSlots == 0 || p.queuedSessions.len() == 0 {
+		return
+	}
+
+	for _, session := range p.queuedSessions.pop(freeSlots) {
+		// On tente d'affecter la session à un backend avec de la place disponible
+		// en prenant en compte la notion de poids
+		var stored bool
+		for _, backend := range balance(availableBackends) {
+			if backend.adoptSession(session) {
+				stored = true
+				p.metrics.admissions.Inc()
+				backend.counters.traffic.countAdmissions(1)
+				waited := session.admit()
+				p.observeAdmission(session, waited)
+				p.events.emitAdmitted(session, backend, waited)
+				sessionsLog.WithFields(log.Fields{
+					"pool":    p.name,
+					"session": session.id,
+					"backend": backend.name,
+					"lane":    session.lane,
+					"waited":  waited.String(),
+				}).Debug("Session promoted from the queue")
+				break
+			}
+		}
+		// Sinon on replace la session au début de la file d'attente
+		if !stored {
+			p.queuedSessions.unshift(session)
+		}
+	}
+}
+
+// syncNewWhitelistedSession admits a whitelisted client directly on a backend
+// with remaining places, without going through the queue.
+func (p *pool) syncNewWhitelistedSession(client string, binding *sessionBinding) (*session, *backend, bool) {
+	p.sessionsLock.Lock()
+	defer p.sessionsLock.Unlock()
+
+	id := xid.New().String()
+	for _, backend := range balance(p.availableBackends()) {
+		if session, ok := backend.storeWhitelistedSession(id); ok {
+			session.binding = binding
+			p.assignClient(session, client)
+			p.emitDirectAdmission(session, backend)
+			return session, backend, true
+		}
+	}
+
+	return nil, nil, false
+}
+
+// syncNewAdmittedSession admits a session directly on the backend with the
+// given name, or on a backend chosen by weight when it is empty or unknown,
+// even if the backend has no remaining places.
+func (p *pool) syncNewAdmittedSession(backendName string, client string, binding *sessionBinding) (*session, *backend) {
+	p.sessionsLock.Lock()
+	defer p.sessionsLock.Unlock()
+
+	backend, ok := p.backendByName(backendName)
+	if !ok {
+		backends := p.availableBackends()
+		if len(backends) == 0 {
+			backends = p.backends()
+		}
+		backend = balance(backends)[0]
+	}
+
+	session := newSession(xid.New().String(), backend.sessionTTL)
+	session.binding = binding
+	backend.sessionStore.store(session)
+	p.assignClient(session, client)
+	p.emitDirectAdmission(session, backend)
+
+	return session, backend
+}
+
+// syncNewReservedSession admits a session on a backend with remaining places
+// reserved for invitation code holders.
+func (p *pool) syncNewReservedSession(client string, binding *sessionBinding) (*session, *backend, bool) {
+	p.sessionsLock.Lock()
+	defer p.sessionsLock.Unlock()
+
+	id := xid.New().String()
+	for _, backend := range balance(p.backends()) {
+		if session, ok := backend.storeReservedSession(id); ok {
+			session.binding = binding
+			p.assignClient(session, client)
+			p.emitDirectAdmission(session, backend)
+			return session, backend, true
+		}
+	}
+
+	return nil, nil, false
+}
+
+// emitDirectAdmission counts and emits the events of a session admitted
+// without going through the queue.
+func (p *pool) emitDirectAdmission(s *session, b *backend) {
+	s.admit()
+	p.metrics.admissions.Inc()
+	b.counters.traffic.countAdmissions(1)
+	p.events.emit(eventSessionCreated, s, b)
+	p.events.emitAdmitted(s, b, 0)
+}
+
+func (p *pool) remainingReservedPlaces() int {
+	remainingPlaces := 0
+	for _, backend := range p.backends() {
+		remainingPlaces += backend.remainingReservedPlaces()
+	}
+
+	return remainingPlaces
+}
+
+// syncBypassBackend chooses a backend for traffic bypassing the queue without
+// a session, backends with remaining places are preferred.
+func (p *pool) syncBypassBackend() *backend {
+	p.sessionsLock.RLock()
+	backends := p.availableBackends()
+	p.sessionsLock.RUnlock()
+
+	if len(backends) == 0 {
+		backends = p.backends()
+	}
+
+	return balance(backends)[0]
+}
+
+// syncFailover chooses a backend with remaining places which has not been
+// tried yet and moves the session, if any, to it.
+func (p *pool) syncFailover(session *session, from *backend, tried []*backend) *backend {
+	p.sessionsLock.Lock()
+	defer p.sessionsLock.Unlock()
+
+	for _, backend := range balance(p.availableBackends()) {
+		if containsBackend(tried, backend) {
+			continue
+		}
+
+		if session == nil {
+			return backend
+		}
+
+		if backend.adoptSession(session) {
+			from.removeSession(session.id)
+			p.events.emitMigrated(session, from, backend)
+			return backend
+		}
+	}
+
+	return nil
+}
+
+func (p *pool) syncStatistics() *PoolStatistics {
+	config := p.config()
+
+	p.sessionsLock.RLock()
+	statistics := PoolStatistics{
+		Name:              p.name,
+		QueuedSessions:    p.queuedSessions.len(),
+		MaxQueuedSessions: config.maxQueuedSessions,
+		QueuedSessionTTL:  config.queuedSessionTTL.String(),
+		QueuedLanes:       p.queuedSessions.lanesLen(),
+		QueueWaitLanes:    p.queueWaits.statistics(),
+		Backends:          make([]*BackendStatistics, 0),
+
+		QueueFullRejections: atomic.LoadUint64(&p.queueFullRejections),
+	}
+
+	for _, backend := range p.backends() {
+		backendStatistics := backend.statistics()
+		statistics.WhitelistedRequests += backendStatistics.WhitelistedRequests
+		statistics.BypassedRequests += backendStatistics.BypassedRequests
+		statistics.Backends = append(statistics.Backends, backendStatistics)
+	}
+	p.sessionsLock.RUnlock()
+
+	return &statistics
+}
+
+// resetTraffic sets the traffic statistics of the backends back to zero.
+func (p *pool) resetTraffic() {
+	for _, backend := range p.backends() {
+		backend.counters.traffic.reset()
+	}
+}
@@ -1,6 +1,11 @@
 package qproxy
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
 
 type proxyHandler struct {
 	qp *QProxy
@@ -11,37 +16,146 @@ func newProxyHandler(qp *QProxy) *proxyHandler {
 }
 
 func (handler *proxyHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	clientIP, _ := handler.qp.getClientIP(r)
+	serve := func(rw http.ResponseWriter, r *http.Request) {
+		handler.qp.tracer.serveTraced(rw, r, clientIP, func(rw http.ResponseWriter, r *http.Request) {
+			handler.serve(rw, r, clientIP)
+		})
+	}
+
+	if !handler.qp.accessLog.enabled() {
+		serve(rw, r)
+		return
+	}
+
+	handler.qp.accessLog.serveLogged(rw, r, clientIP, serve)
+}
+
+func (handler *proxyHandler) serve(rw http.ResponseWriter, r *http.Request, clientIP string) {
 	qp := handler.qp
-	if qp.isRequestWhitelisted(r) {
-		qp.randomBackend().handler.ServeHTTP(rw, r)
+	room := qp.routeRoom(r)
+	roomConfig := room.config()
+	pool := room.routePool(r)
+	entry := accessLogEntryFromContext(r.Context())
+	entry.setRoute(room, pool)
+
+	// Credentials are removed from the request before any decision, so that
+	// they are neither forwarded to the backends nor logged.
+	signed, hasBypassToken := roomConfig.bypassTokens.extractBypassToken(r)
+	code, hasInvitationCode := roomConfig.invitations.extractInvitationCode(r)
+
+	lane := defaultLaneName
+	var forceQueue bool
+	if rule, ok := matchRequestRule(roomConfig.rules, &ruleContext{r: r, clientIP: clientIP}); ok {
+		switch rule.action {
+		case ruleActionDeny:
+			entry.setOutcome(outcomeDenied)
+			handler.serveDenied(rw, roomConfig)
+			return
+		case ruleActionBypass:
+			entry.setOutcome(outcomeBypassed)
+			handler.serveBypassed(rw, r, room, pool, clientIP)
+			return
+		case ruleActionForceQueue:
+			forceQueue = true
+		case ruleActionLane:
+			lane = rule.lane
+		}
+	}
+
+	if !roomConfig.schedule.active(time.Now()) {
+		if roomConfig.schedule.outside == scheduleOutsideClosed {
+			entry.setOutcome(outcomeClosed)
+			roomConfig.schedule.serveClosed(rw)
+			return
+		}
+
+		entry.setOutcome(outcomeBypassed)
+		handler.serveBypassed(rw, r, room, pool, clientIP)
+		return
+	}
+
+	if hasBypassToken {
+		if session, backend, ok := handler.admitBypassToken(rw, r, room, pool, signed, clientIP); ok {
+			entry.setOutcome(outcomeAdmitted)
+			qp.serveBackend(rw, r, pool, session, backend)
+			return
+		}
+	}
+
+	if hasInvitationCode {
+		if session, backend, ok := handler.admitInvitation(rw, r, room, pool, code, clientIP); ok {
+			entry.setOutcome(outcomeAdmitted)
+			qp.serveBackend(rw, r, pool, session, backend)
+			return
+		}
+	}
+
+	if qp.isIPWhitelisted(clientIP) {
+		entry.setOutcome(outcomeWhitelisted)
+		handler.serveWhitelisted(rw, r, room, pool, clientIP)
+		return
+	}
+
+	if roomConfig.gate.bypasses(r) {
+		entry.setOutcome(outcomeBypassed)
+		handler.serveBypassed(rw, r, room, pool, clientIP)
 		return
 	}
 
 	var sessionID string
-	cookieName := qp.config.getString("cookie_name")
-	if sessionCookie, err := r.Cookie(cookieName); err == nil {
+	config := pool.config()
+	if sessionCookie, err := r.Cookie(config.cookieName); err == nil {
 		sessionID = sessionCookie.Value
 	}
 
 	var session *session
 	var backend *backend
+	client := config.quotas.clientKey(clientIP)
 	if qp.isValidSessionID(sessionID) {
-		session, backend, _ = qp.syncLoadSession(sessionID)
-	} else if !qp.syncHasRemainingQueueSlots() {
-		qp.config.getTemplate("queue.full_template").Execute(rw, nil)
+		session, backend, _ = pool.syncLoadSession(sessionID)
+		if session != nil && !room.checkBinding(pool, session, clientIP, r.UserAgent()) {
+			sessionsLog.WithFields(log.Fields{"client": client}).Warning("Session used by another client")
+			session, backend, forceQueue = nil, nil, true
+		}
+	} else if !pool.syncHasRemainingQueueSlots() {
+		entry.setOutcome(outcomeFull)
+		pool.countQueueFull()
+		config.fullTemplate.Execute(rw, nil)
+		return
+	}
+
+	if session == nil && !roomConfig.handshake.completed(r, room.handshakeUsage) {
+		entry.setOutcome(outcomeHandshake)
+		roomConfig.handshake.serve(rw, r)
+		return
+	}
+
+	if session == nil && !pool.syncHasRemainingClientQuota(client) {
+		sessionsLog.WithFields(log.Fields{"client": client}).Warning("Client over sessions quota")
+		entry.setOutcome(outcomeQuota)
+		serveQuotaExceeded(rw, config.quotas)
+		return
+	}
+
+	if session == nil && !room.admitChallenge(rw, r, pool) {
+		entry.setOutcome(outcomeChallenge)
 		return
 	}
 
 	if session == nil {
 		var ok bool
-		session, backend, ok = qp.syncNewSession()
+		binding := roomConfig.binding.newSessionBinding(clientIP, r.UserAgent())
+		session, backend, ok = room.newSession(r, pool, client, binding, lane, forceQueue)
 		if !ok {
-			qp.config.getTemplate("queue.full_template").Execute(rw, nil)
+			entry.setOutcome(outcomeFull)
+			pool.countQueueFull()
+			config.fullTemplate.Execute(rw, nil)
 			return
 		}
 
 		http.SetCookie(rw, &http.Cookie{
-			Name:     cookieName,
+			Name:     config.cookieName,
 			Path:     "/",
 			Value:    session.id,
 			HttpOnly: true,
@@ -49,9 +163,177 @@ func (handler *proxyHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request)
 	}
 
 	if backend != nil {
-		backend.handler.ServeHTTP(rw, r)
+		entry.setOutcome(outcomeAdmitted)
+		qp.serveBackend(rw, r, pool, session, backend)
+		return
+	}
+
+	entry.setOutcome(outcomeQueued)
+	entry.setSession(session, nil)
+	config.template.Execute(rw, nil)
+}
+
+// serveWhitelisted proxies a whitelisted request without going through the
+// queue. When whitelisted traffic consumes capacity the client is given a
+// session on a backend with remaining places, otherwise the backend may be
+// pinned using a dedicated cookie.
+func (handler *proxyHandler) serveWhitelisted(rw http.ResponseWriter, r *http.Request, room *room, pool *pool, clientIP string) {
+	qp := handler.qp
+	var session *session
+	var backend *backend
+	if qp.config.getBool("whitelist.consume_capacity") {
+		session, backend = handler.whitelistedSession(rw, r, room, pool, clientIP)
+	}
+
+	if backend == nil {
+		backend = handler.pinnedBackend(rw, r, pool)
+	}
+
+	backend.countWhitelistedRequest()
+	qp.serveBackend(rw, r, pool, session, backend)
+}
+
+// admitBypassToken admits the holder of a valid bypass token directly, clients
+// which are already admitted keep their session.
+func (handler *proxyHandler) admitBypassToken(rw http.ResponseWriter, r *http.Request, room *room, pool *pool, signed string, clientIP string) (*session, *backend, bool) {
+	token, err := parseBypassToken(room.config().bypassTokens.secret, signed)
+	if err != nil {
+		sessionsLog.WithFields(log.Fields{"error": err}).Warning("Bypass token rejected")
+		return nil, nil, false
+	}
+
+	if session, backend := handler.loadSession(r, room, pool, clientIP); backend != nil {
+		return session, backend, true
+	}
+
+	if !room.tokenUsage.use(token) {
+		sessionsLog.WithFields(log.Fields{"token": token.ID}).Warning("Bypass token used too many times")
+		return nil, nil, false
+	}
+
+	binding := room.config().binding.newSessionBinding(clientIP, r.UserAgent())
+	session, backend := pool.syncNewAdmittedSession(token.Backend, pool.config().quotas.clientKey(clientIP), binding)
+	room.countTokenAdmission()
+	http.SetCookie(rw, &http.Cookie{
+		Name:     pool.config().cookieName,
+		Path:     "/",
+		Value:    session.id,
+		HttpOnly: true,
+	})
+
+	return session, backend, true
+}
+
+// admitInvitation admits the holder of a valid invitation code on the places
+// reserved for invitations, clients which are already admitted keep their
+// session.
+func (handler *proxyHandler) admitInvitation(rw http.ResponseWriter, r *http.Request, room *room, pool *pool, code string, clientIP string) (*session, *backend, bool) {
+	if session, backend := handler.loadSession(r, room, pool, clientIP); backend != nil {
+		return session, backend, true
+	}
+
+	if !room.invitationUsage.use(room.config().invitations, code) {
+		sessionsLog.WithFields(log.Fields{"code": invitationCodeID(code)}).Warning("Invitation code rejected")
+		return nil, nil, false
+	}
+
+	binding := room.config().binding.newSessionBinding(clientIP, r.UserAgent())
+	session, backend, ok := pool.syncNewReservedSession(pool.config().quotas.clientKey(clientIP), binding)
+	if !ok {
+		room.invitationUsage.release(code)
+		return nil, nil, false
+	}
+
+	http.SetCookie(rw, &http.Cookie{
+		Name:     pool.config().cookieName,
+		Path:     "/",
+		Value:    session.id,
+		HttpOnly: true,
+	})
+
+	return session, backend, true
+}
+
+func (handler *proxyHandler) serveDenied(rw http.ResponseWriter, config *roomConfig) {
+	if config.denyTemplate == nil {
+		http.Error(rw, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	qp.config.getTemplate("queue.template").Execute(rw, nil)
+	rw.WriteHeader(http.StatusForbidden)
+	config.denyTemplate.Execute(rw, nil)
+}
+
+// serveBypassed proxies a request bypassing the queue without creating a
+// session, admitted clients keep their backend.
+func (handler *proxyHandler) serveBypassed(rw http.ResponseWriter, r *http.Request, room *room, pool *pool, clientIP string) {
+	session, backend := handler.loadSession(r, room, pool, clientIP)
+	if backend == nil {
+		session = nil
+		backend = pool.syncBypassBackend()
+	}
+
+	backend.countBypassedRequest()
+	handler.qp.serveBackend(rw, r, pool, session, backend)
+}
+
+func (handler *proxyHandler) whitelistedSession(rw http.ResponseWriter, r *http.Request, room *room, pool *pool, clientIP string) (*session, *backend) {
+	if session, backend := handler.loadSession(r, room, pool, clientIP); backend != nil {
+		return session, backend
+	}
+
+	binding := room.config().binding.newSessionBinding(clientIP, r.UserAgent())
+	session, backend, ok := pool.syncNewWhitelistedSession(pool.config().quotas.clientKey(clientIP), binding)
+	if !ok {
+		return nil, nil
+	}
+
+	http.SetCookie(rw, &http.Cookie{
+		Name:     pool.config().cookieName,
+		Path:     "/",
+		Value:    session.id,
+		HttpOnly: true,
+	})
+
+	return session, backend
+}
+
+// loadSession returns the session of the request cookie, sessions used by
+// another client than the one they are bound to are ignored.
+func (handler *proxyHandler) loadSession(r *http.Request, room *room, pool *pool, clientIP string) (*session, *backend) {
+	sessionCookie, err := r.Cookie(pool.config().cookieName)
+	if err != nil || !handler.qp.isValidSessionID(sessionCookie.Value) {
+		return nil, nil
+	}
+
+	session, backend, _ := pool.syncLoadSession(sessionCookie.Value)
+	if session != nil && !room.checkBinding(pool, session, clientIP, r.UserAgent()) {
+		sessionsLog.WithFields(log.Fields{"client": pool.config().quotas.clientKey(clientIP)}).Warning("Session used by another client")
+		return nil, nil
+	}
+
+	return session, backend
+}
+
+func (handler *proxyHandler) pinnedBackend(rw http.ResponseWriter, r *http.Request, pool *pool) *backend {
+	cookieName := pool.config().whitelistCookieName
+	if cookieName == "" {
+		return pool.syncBypassBackend()
+	}
+
+	if pinCookie, err := r.Cookie(cookieName); err == nil {
+		if backend, ok := pool.backendByName(pinCookie.Value); ok {
+			return backend
+		}
+	}
+
+	backend := pool.syncBypassBackend()
+	http.SetCookie(rw, &http.Cookie{
+		Name:     cookieName,
+		Path:     "/",
+		Value:    backend.name,
+		HttpOnly: true,
+	})
+
+	return backend
 }
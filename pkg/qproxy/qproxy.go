@@ -2,9 +2,10 @@ package qproxy
 
 import (
 	"errors"
-	"math/rand"
+	"fmt"
 	"net"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -71,27 +72,34 @@ func newIPList(ips []string) (*ipList, error) {
 	return &ipList{ipList: ipSlice, ipNetList: ipNetSlice}, nil
 }
 
-// ProxyStatistics stores proxy statistics
+// ProxyStatistics stores proxy statistics, room statistics are the ones of the
+// default room while other rooms are listed in Rooms.
 type ProxyStatistics struct {
-	Uptime            string
-	QueuedSessions    int
-	MaxQueuedSessions int
-	QueuedSessionTTL  string
-	Backends          []*BackendStatistics
+	Uptime        string
+	DroppedEvents uint64
+	DroppedSpans  uint64
+	RoomStatistics
+	Rooms []*RoomStatistics
 }
 
 // QProxy stores sessions and disptach them to backends
 type QProxy struct {
-	config         *proxyConfig
-	isStarted      atomicBool
-	inShutdown     atomicBool
-	doneChan       chan struct{}
-	startTime      time.Time
-	server         *http.Server
-	apiServer      *http.Server
-	atomicBackends atomic.Value
-	sessionsLock   sync.RWMutex
-	queuedSessions *sessionStore
+	config      *proxyConfig
+	isStarted   atomicBool
+	inShutdown  atomicBool
+	doneChan    chan struct{}
+	startTime   time.Time
+	server      *http.Server
+	apiServer   *http.Server
+	atomicRooms atomic.Value
+	reloadLock  sync.Mutex
+	metrics     *metrics
+	accessLog   *accessLog
+	history     *history
+	events      *eventBus
+	alerting    *alerting
+	statsd      *statsdExporter
+	tracer      *tracer
 }
 
 // NewQProxy create a Proxy using Viper
@@ -101,22 +109,38 @@ func NewQProxy(v *viper.Viper) (*QProxy, error) {
 		return nil, err
 	}
 
-	qp := QProxy{
-		config:         config,
-		doneChan:       make(chan struct{}),
-		queuedSessions: newSessionStore(),
+	if err := configureLogging(config.getLoggingConfig()); err != nil {
+		return nil, err
 	}
 
-	backends := make([]*backend, 0)
-	for backendName, backendConfig := range config.getBackendsConfig() {
-		backend, err := newBackend(backendName, backendConfig, nil)
-		if err != nil {
-			return nil, err
-		}
+	qp := QProxy{
+		config:   config,
+		doneChan: make(chan struct{}),
+	}
+	qp.atomicRooms.Store(make([]*room, 0))
+	qp.metrics = newMetrics(&qp)
+	qp.events = newEventBus(config.getEventsConfig().bufferSize)
+	if err := qp.events.configure(config.getEventsConfig()); err != nil {
+		return nil, err
+	}
+	qp.accessLog = newAccessLog()
+	if err := qp.accessLog.configure(config.getAccessLogConfig()); err != nil {
+		return nil, err
+	}
+	qp.alerting = newAlerting()
+	qp.statsd = newStatsdExporter()
+	if err := qp.statsd.configure(config.getStatsdConfig()); err != nil {
+		return nil, err
+	}
+	qp.tracer = newTracer(config.getTracingConfig())
+	qp.history = newHistory()
+	if err := qp.history.configure(config.getHistoryConfig()); err != nil {
+		return nil, err
+	}
 
-		backends = append(backends, backend)
+	if err := qp.loadRooms(); err != nil {
+		return nil, err
 	}
-	qp.atomicBackends.Store(backends)
 
 	return &qp, nil
 }
@@ -125,7 +149,7 @@ func NewQProxy(v *viper.Viper) (*QProxy, error) {
 func Start() {
 	qp, err := NewQProxy(viper.GetViper())
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Fatal("Unable to start QProxy")
+		proxyLog.WithFields(log.Fields{"error": err}).Fatal("Unable to start QProxy")
 	}
 
 	qp.ListenAndServe()
@@ -140,7 +164,12 @@ func (qp *QProxy) handleSessionUpdate() {
 			ticker.Stop()
 			return
 		case <-ticker.C:
-			qp.syncUpdateSessions()
+			for _, room := range qp.rooms() {
+				room.syncUpdateSessions()
+			}
+			qp.recordHistory()
+			qp.alerting.evaluate(qp.config.getAlertRules(), qp.rooms())
+			qp.pushStatsd()
 		case <-reloadNotifyChan:
 			ticker.Stop()
 			ticker = time.NewTicker(qp.config.getDuration("session_refresh_interval"))
@@ -148,218 +177,181 @@ func (qp *QProxy) handleSessionUpdate() {
 	}
 }
 
-func (qp *QProxy) syncReloadConfiguration() {
-	if err := qp.config.syncReload(); err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Unable to reload configuration")
+// recordHistory samples the statistics into the history.
+func (qp *QProxy) recordHistory() {
+	if !qp.history.enabled() {
 		return
 	}
 
-	oldBackends := qp.backends()
-	newBackends := make([]*backend, 0)
-	for backendName, backendConfig := range qp.config.getBackendsConfig() {
-		var sessionStore *sessionStore
-		for _, oldBackend := range oldBackends {
-			if oldBackend.name == backendName {
-				sessionStore = oldBackend.sessionStore
-				break
-			}
-		}
-
-		backend, err := newBackend(backendName, backendConfig, sessionStore)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Error("Unable to reload configuration")
-			return
-		}
-
-		newBackends = append(newBackends, backend)
+	if err := qp.history.record(qp.syncStatistics()); err != nil {
+		apiLog.WithFields(log.Fields{"error": err}).Error("Unable to write statistics history")
 	}
-	qp.atomicBackends.Store(newBackends)
-	log.Info("Configuration reloaded")
 }
 
-func (qp *QProxy) randomBackend() *backend {
-	backends := qp.backends()
-
-	return backends[rand.Intn(len(backends))]
-}
+// pushStatsd sends the metrics to the StatsD server.
+func (qp *QProxy) pushStatsd() {
+	if !qp.statsd.enabled() {
+		return
+	}
 
-func (qp *QProxy) backends() []*backend {
-	return qp.atomicBackends.Load().([]*backend)
+	if err := qp.statsd.push(qp.metrics.registry); err != nil {
+		apiLog.WithFields(log.Fields{"error": err}).Error("Unable to push metrics to StatsD")
+	}
 }
 
-func (qp *QProxy) availableBackends() []*backend {
-	availableBackends := make([]*backend, 0)
-	for _, backend := range qp.backends() {
-		if backend.remainingPlaces() > 0 {
-			availableBackends = append(availableBackends, backend)
-		}
+func (qp *QProxy) syncReloadConfiguration() {
+	if err := qp.config.syncReload(); err != nil {
+		configLog.WithFields(log.Fields{"error": err}).Error("Unable to reload configuration")
+		return
 	}
 
-	return availableBackends
-}
+	if err := qp.loadRooms(); err != nil {
+		configLog.WithFields(log.Fields{"error": err}).Error("Unable to reload configuration")
+		return
+	}
 
-func (qp *QProxy) isValidSessionID(id string) bool {
-	if id == "" {
-		return false
+	if err := qp.accessLog.configure(qp.config.getAccessLogConfig()); err != nil {
+		configLog.WithFields(log.Fields{"error": err}).Error("Unable to reload access log configuration")
 	}
 
-	_, err := xid.FromString(id)
+	if err := qp.events.configure(qp.config.getEventsConfig()); err != nil {
+		configLog.WithFields(log.Fields{"error": err}).Error("Unable to reload events configuration")
+	}
 
-	return err == nil
-}
+	if err := qp.statsd.configure(qp.config.getStatsdConfig()); err != nil {
+		configLog.WithFields(log.Fields{"error": err}).Error("Unable to reload StatsD configuration")
+	}
 
-func (qp *QProxy) syncHasRemainingQueueSlots() bool {
-	qp.sessionsLock.RLock()
-	hasRemainingQueueSlots := qp.hasRemainingQueueSlots()
-	qp.sessionsLock.RUnlock()
+	qp.tracer.configure(qp.config.getTracingConfig())
 
-	return hasRemainingQueueSlots
-}
-
-func (qp *QProxy) hasRemainingQueueSlots() bool {
-	maxQueuedSessions := qp.config.getInt("queue.max_sessions")
-	if maxQueuedSessions <= 0 {
-		return true
+	if err := qp.history.configure(qp.config.getHistoryConfig()); err != nil {
+		configLog.WithFields(log.Fields{"error": err}).Error("Unable to reload statistics history configuration")
 	}
 
-	return (maxQueuedSessions - qp.queuedSessions.len()) > 0
+	if err := configureLogging(qp.config.getLoggingConfig()); err != nil {
+		configLog.WithFields(log.Fields{"error": err}).Error("Unable to reload logging configuration")
+	}
+	configLog.Info("Configuration reloaded")
 }
 
-func (qp *QProxy) loadSession(id string) (*session, *backend, bool) {
-	for _, backend := range qp.backends() {
-		if session, ok := backend.loadSession(id); ok {
-			session.update(backend.sessionTTL)
+// loadRooms creates, updates or removes the rooms described by the
+// configuration. The backends of every room are created before any room is
+// updated so a failure leaves the rooms untouched, sessions of the rooms and
+// pools which are kept are preserved.
+func (qp *QProxy) loadRooms() error {
+	qp.reloadLock.Lock()
+	defer qp.reloadLock.Unlock()
+
+	roomsConfig := qp.config.getRoomsConfig()
+	newRooms := make([]*room, 0)
+	updates := make(map[string][]*poolUpdate)
+	for roomName, roomConfig := range roomsConfig {
+		room, ok := qp.room(roomName)
+		if !ok {
+			room = newRoom(roomName, qp.metrics, qp.events)
+		}
 
-			return session, backend, true
+		roomUpdates, err := room.prepare(roomConfig)
+		if err != nil {
+			return fmt.Errorf("[room: %s] %s", roomName, err)
 		}
+
+		newRooms = append(newRooms, room)
+		updates[roomName] = roomUpdates
+	}
+
+	for _, room := range newRooms {
+		room.update(roomsConfig[room.name], updates[room.name])
 	}
 
-	if session, ok := qp.queuedSessions.load(id); ok {
-		session.update(qp.config.getDuration("queue.session_ttl"))
+	// Named rooms are sorted by name to break ties between equally specific
+	// matches, the default room comes last
+	sort.Slice(newRooms, func(i int, j int) bool {
+		if newRooms[i].name == defaultRoomName || newRooms[j].name == defaultRoomName {
+			return newRooms[j].name == defaultRoomName
+		}
+
+		return newRooms[i].name < newRooms[j].name
+	})
+	qp.atomicRooms.Store(newRooms)
 
-		return session, nil, true
+	return nil
+}
+
+func (qp *QProxy) rooms() []*room {
+	return qp.atomicRooms.Load().([]*room)
+}
+
+func (qp *QProxy) room(name string) (*room, bool) {
+	for _, room := range qp.rooms() {
+		if room.name == name {
+			return room, true
+		}
 	}
 
-	return nil, nil, false
+	return nil, false
 }
 
-func (qp *QProxy) syncLoadSession(id string) (*session, *backend, bool) {
-	qp.sessionsLock.RLock()
-	session, backend, ok := qp.loadSession(id)
-	qp.sessionsLock.RUnlock()
+func (qp *QProxy) defaultRoom() *room {
+	rooms := qp.rooms()
 
-	return session, backend, ok
+	return rooms[len(rooms)-1]
 }
 
-func (qp *QProxy) syncNewSession() (*session, *backend, bool) {
-	qp.sessionsLock.Lock()
-	defer qp.sessionsLock.Unlock()
-
-	id := xid.New().String()
-
-	if qp.queuedSessions.len() == 0 {
-		backends := qp.availableBackends()
-		if len(backends) > 0 {
-			rand.Shuffle(len(backends), func(i int, j int) {
-				backends[i], backends[j] = backends[j], backends[i]
-			})
-			rndWeight := rand.Float64()
-			backendsLastIdx := len(backends) - 1
-			for idx, backend := range backends {
-				if backend.weight >= rndWeight || idx == backendsLastIdx {
-					if session, ok := backend.storeSession(id); ok {
-						return session, backend, true
-					}
-				}
-			}
+// routeRoom returns the named room matching the request the most
+// specifically, or the default room.
+func (qp *QProxy) routeRoom(r *http.Request) *room {
+	var best *room
+	var bestMatch roomMatch
+	for _, room := range qp.rooms() {
+		if room.name == defaultRoomName {
+			continue
+		}
+
+		if match, ok := room.config().match(r); ok && (best == nil || match.beats(bestMatch)) {
+			best, bestMatch = room, match
 		}
 	}
 
-	if !qp.hasRemainingQueueSlots() {
-		return nil, nil, false
+	if best == nil {
+		return qp.defaultRoom()
 	}
 
-	return qp.queuedSessions.store(newSession(id, qp.config.getDuration("queue.session_ttl"))), nil, true
+	return best
 }
 
-func (qp *QProxy) syncUpdateSessions() {
-	qp.sessionsLock.Lock()
-	defer qp.sessionsLock.Unlock()
-
-	freeSlots := 0
-	availableBackends := make([]*backend, 0)
-	qp.queuedSessions.removeExpired()
-	for _, backend := range qp.backends() {
-		backend.removeExpiredSessions()
-		if remainingPlaces := backend.remainingPlaces(); remainingPlaces > 0 {
-			freeSlots += remainingPlaces
-			availableBackends = append(availableBackends, backend)
-		}
+func (qp *QProxy) isValidSessionID(id string) bool {
+	if id == "" {
+		return false
 	}
 
-	if freeSlots == 0 || qp.queuedSessions.len() == 0 {
-		return
-	}
+	_, err := xid.FromString(id)
 
-	for _, session := range qp.queuedSessions.pop(freeSlots) {
-		// On mélange la liste des backends pour éviter de toujours ajouter les sessions sur le même
-		rand.Shuffle(len(availableBackends), func(i int, j int) {
-			availableBackends[i], availableBackends[j] = availableBackends[j], availableBackends[i]
-		})
-		// On génère une valeur de poids aléatoire
-		rndWeight := rand.Float64()
-		var stored bool
-		// Dans cette boucle on on tente d'affecter la session à un backend avec de la place
-		// disponnible tout en prennant en compte la notion de poids
-		for _, backend := range availableBackends {
-			if backend.remainingPlaces() == 0 {
-				continue
-			}
-			if rndWeight > backend.weight {
-				continue
-			}
-			if _, ok := backend.storeSession(session.id); ok {
-				stored = true
-				break
-			}
-		}
-		// Si la session a été affectée on passe à la suivante
-		if stored {
-			continue
-		}
-		// Dans cette boucle on tente d'affecter la session au premier backend avec de la place
-		for _, backend := range availableBackends {
-			if backend.remainingPlaces() == 0 {
-				continue
-			}
-			if _, ok := backend.storeSession(session.id); ok {
-				stored = true
-				break
-			}
-		}
-		// Si la session a été affectée on passe à la suivante
-		if stored {
-			continue
-		}
-		// Sinon on replace la session au début de la file d'attente
-		qp.queuedSessions.unshift(session)
+	return err == nil
+}
+
+func (qp *QProxy) resetTraffic() {
+	for _, room := range qp.rooms() {
+		room.resetTraffic()
 	}
 }
 
 func (qp *QProxy) syncStatistics() *ProxyStatistics {
-	qp.sessionsLock.RLock()
 	statistics := ProxyStatistics{
-		Uptime:            time.Now().Sub(qp.startTime).String(),
-		QueuedSessions:    qp.queuedSessions.len(),
-		MaxQueuedSessions: qp.config.getInt("queue.max_sessions"),
-		QueuedSessionTTL:  qp.config.getDuration("queue.session_ttl").String(),
-		Backends:          make([]*BackendStatistics, 0),
+		Uptime:        time.Now().Sub(qp.startTime).String(),
+		DroppedEvents: atomic.LoadUint64(&qp.events.dropped),
+		DroppedSpans:  atomic.LoadUint64(&qp.tracer.dropped),
+		Rooms:         make([]*RoomStatistics, 0),
 	}
 
-	for _, backend := range qp.backends() {
-		statistics.Backends = append(statistics.Backends, backend.statistics())
+	for _, room := range qp.rooms() {
+		if room.name == defaultRoomName {
+			statistics.RoomStatistics = *room.syncStatistics()
+			continue
+		}
+
+		statistics.Rooms = append(statistics.Rooms, room.syncStatistics())
 	}
-	qp.sessionsLock.RUnlock()
 
 	return &statistics
 }
@@ -367,7 +359,7 @@ func (qp *QProxy) syncStatistics() *ProxyStatistics {
 func (qp *QProxy) getClientIP(r *http.Request) (string, bool) {
 	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Error while processing request")
+		proxyLog.WithFields(log.Fields{"error": err}).Error("Error while processing request")
 		return "", false
 	}
 
@@ -387,7 +379,7 @@ func (qp *QProxy) getClientIP(r *http.Request) (string, bool) {
 		}
 	}
 
-	log.WithFields(log.Fields{
+	proxyLog.WithFields(log.Fields{
 		"error":           "Unable to guess client IP",
 		"remote-addr":     remoteIP,
 		"x-forwarded-for": forwardedFor,
@@ -395,10 +387,6 @@ func (qp *QProxy) getClientIP(r *http.Request) (string, bool) {
 	return "", false
 }
 
-func (qp *QProxy) isRequestWhitelisted(r *http.Request) bool {
-	if clientIP, ok := qp.getClientIP(r); ok {
-		return qp.config.getIPList("whitelisted_ips").contains(clientIP)
-	}
-
-	return false
+func (qp *QProxy) isIPWhitelisted(clientIP string) bool {
+	return qp.config.getIPList("whitelisted_ips").contains(clientIP)
 }
@@ -0,0 +1,146 @@
+package qproxy
+
+const defaultLaneName = "default"
+
+// laneQueue is a queue made of lanes ordered by priority, sessions of a lane
+// are promoted before the sessions of the following lanes.
+type laneQueue struct {
+	lanes  []string
+	stores map[string]*sessionStore
+}
+
+func newLaneQueue() *laneQueue {
+	return &laneQueue{
+		lanes:  []string{defaultLaneName},
+		stores: map[string]*sessionStore{defaultLaneName: newSessionStore()},
+	}
+}
+
+// setLanes updates the lanes of the queue, the default lane comes last when it
+// is not listed. Sessions of the removed lanes are moved to the default lane.
+func (q *laneQueue) setLanes(lanes []string) {
+	newLanes := make([]string, 0)
+	newStores := make(map[string]*sessionStore)
+	for _, lane := range lanes {
+		if _, ok := newStores[lane]; ok {
+			continue
+		}
+
+		newLanes = append(newLanes, lane)
+		newStores[lane] = newSessionStore()
+		if store, ok := q.stores[lane]; ok {
+			newStores[lane] = store
+		}
+	}
+
+	if _, ok := newStores[defaultLaneName]; !ok {
+		newLanes = append(newLanes, defaultLaneName)
+		newStores[defaultLaneName] = q.stores[defaultLaneName]
+	}
+
+	for _, lane := range q.lanes {
+		if _, ok := newStores[lane]; ok {
+			continue
+		}
+
+		for _, s := range q.stores[lane].sessions {
+			s.lane = defaultLaneName
+			newStores[defaultLaneName].store(s)
+		}
+	}
+
+	q.lanes = newLanes
+	q.stores = newStores
+}
+
+func (q *laneQueue) laneStore(lane string) *sessionStore {
+	if store, ok := q.stores[lane]; ok {
+		return store
+	}
+
+	return q.stores[defaultLaneName]
+}
+
+func (q *laneQueue) load(id string) (*session, bool) {
+	for _, lane := range q.lanes {
+		if s, ok := q.stores[lane].load(id); ok {
+			return s, true
+		}
+	}
+
+	return nil, false
+}
+
+func (q *laneQueue) store(s *session) *session {
+	if existing, ok := q.load(s.id); ok {
+		return existing
+	}
+
+	if _, ok := q.stores[s.lane]; !ok {
+		s.lane = defaultLaneName
+	}
+
+	return q.stores[s.lane].store(s)
+}
+
+func (q *laneQueue) remove(id string) bool {
+	for _, lane := range q.lanes {
+		if q.stores[lane].remove(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removeExpired removes the expired sessions, which abandoned the queue, and
+// returns them.
+func (q *laneQueue) removeExpired() []*session {
+	removed := make([]*session, 0)
+	for _, lane := range q.lanes {
+		removed = append(removed, q.stores[lane].removeExpired()...)
+	}
+
+	return removed
+}
+
+// pop removes and returns at most size sessions, by lane priority.
+func (q *laneQueue) pop(size int) []*session {
+	sessions := make([]*session, 0)
+	for _, lane := range q.lanes {
+		if len(sessions) == size {
+			break
+		}
+
+		sessions = append(sessions, q.stores[lane].pop(size-len(sessions))...)
+	}
+
+	return sessions
+}
+
+// unshift puts back a session at the beginning of its lane.
+func (q *laneQueue) unshift(s *session) bool {
+	if _, ok := q.load(s.id); ok {
+		return false
+	}
+
+	return q.laneStore(s.lane).unshift(s)
+}
+
+func (q *laneQueue) len() int {
+	length := 0
+	for _, store := range q.stores {
+		length += store.len()
+	}
+
+	return length
+}
+
+func (q *laneQueue) lanesLen() map[string]int {
+	lanesLen := make(map[string]int)
+	for lane, store := range q.stores {
+		lanesLen[lane] = store.len()
+	}
+
+	return lanesLen
+}
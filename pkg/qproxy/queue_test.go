@@ -0,0 +1,34 @@
+package qproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLaneQueue(t *testing.T) {
+	q := newLaneQueue()
+	q.setLanes([]string{"priority"})
+	assert.Equal(t, []string{"priority", defaultLaneName}, q.lanes)
+
+	first := newSession("first", time.Minute)
+	vip := newSession("vip", time.Minute)
+	vip.lane = "priority"
+	unknown := newSession("unknown", time.Minute)
+	unknown.lane = "unknown"
+	q.store(first)
+	q.store(vip)
+	q.store(unknown)
+	assert.Equal(t, 3, q.len())
+	assert.Equal(t, map[string]int{"priority": 1, defaultLaneName: 2}, q.lanesLen())
+
+	sessions := q.pop(2)
+	assert.Equal(t, []*session{vip, first}, sessions)
+
+	q.unshift(vip)
+	q.setLanes([]string{})
+	assert.Equal(t, []string{defaultLaneName}, q.lanes)
+	assert.Equal(t, defaultLaneName, vip.lane)
+	assert.Equal(t, []*session{unknown, vip}, q.pop(5))
+}
@@ -0,0 +1,114 @@
+package qproxy
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+
+	"github.com/spf13/viper"
+)
+
+type quotasConfig struct {
+	maxQueuedSessions int
+	maxSessions       int
+	ipv6Prefix        int
+	template          *template.Template
+}
+
+func newQuotasConfig(v *viper.Viper) (*quotasConfig, error) {
+	v.SetDefault("quotas.ipv6_prefix", 64)
+
+	config := quotasConfig{
+		maxQueuedSessions: v.GetInt("quotas.max_queued_sessions_per_ip"),
+		maxSessions:       v.GetInt("quotas.max_sessions_per_ip"),
+		ipv6Prefix:        v.GetInt("quotas.ipv6_prefix"),
+	}
+
+	if v.GetString("quotas.template") != "" {
+		quotaTemplate, err := template.ParseFiles(v.GetString("quotas.template"))
+		if err != nil {
+			return nil, err
+		}
+		config.template = quotaTemplate
+	}
+
+	return &config, nil
+}
+
+func validateQuotasConfig(v *viper.Viper) error {
+	for _, key := range []string{"quotas.max_queued_sessions_per_ip", "quotas.max_sessions_per_ip"} {
+		if v.GetInt(key) < 0 {
+			return fmt.Errorf("Option `%s` must be greater or equals than 0", key)
+		}
+	}
+
+	if prefix := v.GetInt("quotas.ipv6_prefix"); prefix < 0 || prefix > 128 {
+		return errors.New("Option `quotas.ipv6_prefix` must be between 0 and 128")
+	}
+
+	return nil
+}
+
+func (config *quotasConfig) enabled() bool {
+	return config.maxQueuedSessions > 0 || config.maxSessions > 0
+}
+
+// clientKey identifies the client owning a session, IPv6 clients are grouped
+// by network as they usually own a whole prefix.
+func (config *quotasConfig) clientKey(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return clientIP
+	}
+
+	if ip.To4() != nil {
+		return ip.String()
+	}
+
+	return fmt.Sprintf("%s/%d", maskIP(ip, 32, config.ipv6Prefix), config.ipv6Prefix)
+}
+
+type clientCounts struct {
+	queued   int
+	admitted int
+}
+
+// clientIndex counts the queued and admitted sessions of each client, it is
+// rebuilt from the session stores on each sessions update and kept up to date
+// when sessions are created in between.
+type clientIndex map[string]*clientCounts
+
+func (index clientIndex) counts(client string) *clientCounts {
+	counts, ok := index[client]
+	if !ok {
+		counts = &clientCounts{}
+		index[client] = counts
+	}
+
+	return counts
+}
+
+func (index clientIndex) exceeds(config *quotasConfig, client string) bool {
+	counts, ok := index[client]
+	if client == "" || !ok {
+		return false
+	}
+
+	if config.maxQueuedSessions > 0 && counts.queued >= config.maxQueuedSessions {
+		return true
+	}
+
+	return config.maxSessions > 0 && counts.admitted >= config.maxSessions
+}
+
+func serveQuotaExceeded(rw http.ResponseWriter, config *quotasConfig) {
+	if config.template == nil {
+		http.Error(rw, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+
+	rw.WriteHeader(http.StatusTooManyRequests)
+	config.template.Execute(rw, nil)
+}
@@ -0,0 +1,122 @@
+package qproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientKey(t *testing.T) {
+	v := newViper()
+	config, err := newQuotasConfig(v)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", config.clientKey("192.0.2.1"))
+	assert.Equal(t, "2001:db8:1:2::/64", config.clientKey("2001:db8:1:2:3:4:5:6"))
+	assert.Equal(t, config.clientKey("2001:db8:1:2::1"), config.clientKey("2001:db8:1:2::2"))
+
+	v.Set("quotas.ipv6_prefix", 48)
+	config, err = newQuotasConfig(v)
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8:1::/48", config.clientKey("2001:db8:1:2:3:4:5:6"))
+	assert.Equal(t, "192.0.2.1", config.clientKey("192.0.2.1"))
+
+	v.Set("quotas.ipv6_prefix", 129)
+	assert.EqualError(t, validateQuotasConfig(v), "Option `quotas.ipv6_prefix` must be between 0 and 128")
+}
+
+func TestClientQuotas(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("quotas.max_queued_sessions_per_ip", 1)
+	v.Set("quotas.max_sessions_per_ip", 1)
+	require.NoError(t, ValidateProxyConfig(v))
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	pool := qp.defaultRoom().defaultPool()
+
+	_, backend, ok := pool.syncNewSession("192.0.2.1", nil, defaultLaneName, false)
+	require.True(t, ok)
+	require.NotNil(t, backend)
+	assert.False(t, pool.syncHasRemainingClientQuota("192.0.2.1"))
+
+	_, _, ok = pool.syncNewSession("192.0.2.1", nil, defaultLaneName, false)
+	assert.False(t, ok)
+
+	_, backend, ok = pool.syncNewSession("192.0.2.2", nil, defaultLaneName, false)
+	require.True(t, ok)
+	assert.Nil(t, backend)
+
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.2:1234"
+	newProxyHandler(qp).ServeHTTP(rw, r)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+
+	pool.syncUpdateSessions()
+	assert.Equal(t, &clientCounts{admitted: 1}, pool.clients["192.0.2.1"])
+	assert.Equal(t, &clientCounts{queued: 1}, pool.clients["192.0.2.2"])
+
+	v.Set("quotas.max_sessions_per_ip", -1)
+	assert.EqualError(t, ValidateProxyConfig(v), "Option `quotas.max_sessions_per_ip` must be greater or equals than 0")
+}
+
+func TestClientQuotaPromotion(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("quotas.max_sessions_per_ip", 2)
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	pool := qp.defaultRoom().defaultPool()
+
+	admitted, backend, ok := pool.syncNewSession("192.0.2.1", nil, defaultLaneName, false)
+	require.True(t, ok)
+	require.NotNil(t, backend)
+	queued, backend, ok := pool.syncNewSession("192.0.2.2", nil, defaultLaneName, false)
+	require.True(t, ok)
+	require.Nil(t, backend)
+
+	pool.backends()[0].removeSession(admitted.id)
+	pool.syncUpdateSessions()
+
+	promoted, backend, ok := pool.syncLoadSession(queued.id)
+	require.True(t, ok)
+	require.NotNil(t, backend)
+	assert.Equal(t, "192.0.2.2", promoted.client)
+	assert.Equal(t, defaultLaneName, promoted.lane)
+	assert.Equal(t, &clientCounts{admitted: 1}, pool.clients["192.0.2.2"])
+}
+
+func TestClientQuotaDirectAdmissions(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 3)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("quotas.max_sessions_per_ip", 1)
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	pool := qp.defaultRoom().defaultPool()
+	pool.backends()[0].reservedSessions = 1
+
+	pool.syncNewAdmittedSession("", "192.0.2.1", nil)
+	assert.False(t, pool.syncHasRemainingClientQuota("192.0.2.1"))
+
+	_, _, ok := pool.syncNewReservedSession("192.0.2.2", nil)
+	require.True(t, ok)
+	_, _, ok = pool.syncNewWhitelistedSession("192.0.2.3", nil)
+	require.True(t, ok)
+
+	pool.syncUpdateSessions()
+	for _, client := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		assert.Equal(t, &clientCounts{admitted: 1}, pool.clients[client], client)
+	}
+}
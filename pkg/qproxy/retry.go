@@ -0,0 +1,112 @@
+package qproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type contextKey int
+
+const (
+	proxyAttemptKey contextKey = iota
+	accessLogEntryKey
+	requestTraceKey
+)
+
+// proxyAttempt is attached to the request context while proxying to a backend,
+// it records connection errors instead of answering when the request may be
+// retried on another backend.
+type proxyAttempt struct {
+	retriable bool
+	err       error
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func handleBackendError(rw http.ResponseWriter, r *http.Request, err error) {
+	if attempt, ok := r.Context().Value(proxyAttemptKey).(*proxyAttempt); ok && attempt.retriable && isDialError(err) {
+		attempt.err = err
+		return
+	}
+
+	proxyLog.WithFields(log.Fields{"error": err, "url": r.URL.String()}).Error("Backend error")
+	rw.WriteHeader(http.StatusBadGateway)
+}
+
+func (qp *QProxy) isRetriable(r *http.Request) bool {
+	if r.Body != nil && r.Body != http.NoBody {
+		return false
+	}
+
+	for _, method := range qp.config.getStringSlice("retry.methods") {
+		if strings.EqualFold(method, r.Method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveBackend proxies the request to the backend. Idempotent requests are
+// retried on other backends with remaining places when the backend can not be
+// reached, the session then follows the request to the new backend.
+func (qp *QProxy) serveBackend(rw http.ResponseWriter, r *http.Request, pool *pool, session *session, target *backend) {
+	start := time.Now()
+	recorder := newResponseRecorder(rw)
+	defer func() {
+		accessLogEntryFromContext(r.Context()).setSession(session, target)
+		pool.metrics.requestDuration.WithLabelValues(target.name, recorder.statusCode()).Observe(time.Since(start).Seconds())
+	}()
+	rw = recorder
+
+	trace := requestTraceFromContext(r.Context())
+	maxAttempts := qp.config.getInt("retry.max_attempts")
+	if maxAttempts == 0 || !qp.isRetriable(r) {
+		upstream := trace.startUpstream(r, target)
+		target.ServeHTTP(rw, r)
+		trace.finishUpstream(upstream, recorder.status, nil)
+		return
+	}
+
+	tried := make([]*backend, 0)
+	for {
+		attempt := &proxyAttempt{retriable: len(tried) < maxAttempts}
+		upstream := trace.startUpstream(r, target)
+		target.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), proxyAttemptKey, attempt)))
+		trace.finishUpstream(upstream, recorder.status, attempt.err)
+		if attempt.err == nil {
+			return
+		}
+
+		tried = append(tried, target)
+		next := pool.syncFailover(session, target, tried)
+		if next == nil {
+			proxyLog.WithFields(log.Fields{"error": attempt.err, "backend": target.name}).Error("Backend error, no backend available for failover")
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		proxyLog.WithFields(log.Fields{"error": attempt.err, "backend": target.name, "failover": next.name}).Warning("Backend error, retrying request")
+		target = next
+	}
+}
+
+func containsBackend(backends []*backend, b *backend) bool {
+	for _, backend := range backends {
+		if backend == b {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,47 @@
+package qproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailover(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer up.Close()
+
+	v := newViper()
+	v.Set("retry.max_attempts", 1)
+	v.Set("backends.down.url", down.URL)
+	v.Set("backends.down.max_sessions", 1)
+	v.Set("backends.down.session_ttl", 5)
+	v.Set("backends.up.url", up.URL)
+	v.Set("backends.up.max_sessions", 1)
+	v.Set("backends.up.session_ttl", 5)
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+
+	from, _ := qp.defaultRoom().defaultPool().backendByName("down")
+	to, _ := qp.defaultRoom().defaultPool().backendByName("up")
+	session, ok := from.storeSession("session")
+	require.True(t, ok)
+
+	rw := httptest.NewRecorder()
+	qp.serveBackend(rw, httptest.NewRequest(http.MethodGet, "/", nil), qp.defaultRoom().defaultPool(), session, from)
+	assert.Equal(t, "ok", rw.Body.String())
+	_, ok = to.loadSession("session")
+	assert.True(t, ok)
+	_, ok = from.loadSession("session")
+	assert.False(t, ok)
+
+	rw = httptest.NewRecorder()
+	qp.serveBackend(rw, httptest.NewRequest(http.MethodPost, "/", nil), qp.defaultRoom().defaultPool(), nil, from)
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+}
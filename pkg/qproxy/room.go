@@ -0,0 +1,340 @@
+package qproxy
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+const defaultRoomName = "default"
+
+// RoomStatistics stores room statistics, queue and backends statistics are the
+// ones of the default pool while other pools are listed in Pools.
+type RoomStatistics struct {
+	Name              string
+	QueuedSessions    int
+	MaxQueuedSessions int
+	QueuedSessionTTL  string
+	QueuedLanes       map[string]int
+	QueueWaitLanes    map[string]*QueueWaitStatistics
+	QueueWait         *QueueWaitStatistics
+	Backends          []*BackendStatistics
+	Pools             []*PoolStatistics
+
+	WhitelistedRequests uint64
+	BypassedRequests    uint64
+	TokenAdmissions     uint64
+	ChallengesIssued    uint64
+	ChallengesSolved    uint64
+	ChallengesRejected  uint64
+	BindingMismatches   uint64
+}
+
+// room is an independent waiting room with its own pools and routes
+type room struct {
+	tokenAdmissions    uint64
+	challengesIssued   uint64
+	challengesSolved   uint64
+	challengesRejected uint64
+	bindingMismatches  uint64
+	name               string
+	atomicConfig       atomic.Value
+	atomicPools        atomic.Value
+	tokenUsage         *tokenUsage
+	invitationUsage    *invitationUsage
+	challengeUsage     *challengeUsage
+	handshakeUsage     *challengeUsage
+	metrics            *metrics
+	events             *eventBus
+}
+
+type poolUpdate struct {
+	pool     *pool
+	config   *poolConfig
+	backends []*backend
+}
+
+func newRoom(name string, metrics *metrics, events *eventBus) *room {
+	rm := room{
+		name:            name,
+		metrics:         metrics,
+		events:          events,
+		tokenUsage:      newTokenUsage(),
+		invitationUsage: newInvitationUsage(),
+		challengeUsage:  newChallengeUsage(),
+		handshakeUsage:  newChallengeUsage(),
+	}
+	rm.atomicPools.Store(make(map[string]*pool))
+
+	return &rm
+}
+
+// prepare creates the backends of the pools described by the configuration
+// without updating the room.
+func (rm *room) prepare(config *roomConfig) ([]*poolUpdate, error) {
+	oldPools := rm.pools()
+	updates := make([]*poolUpdate, 0)
+	for poolName, poolConfig := range config.pools {
+		pool, ok := oldPools[poolName]
+		if !ok {
+			pool = newPool(poolName, rm.metrics.forPool(rm.name, poolName), rm.events.forPool(rm.name, poolName))
+		}
+
+		backends, err := pool.newBackends(poolConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		updates = append(updates, &poolUpdate{pool: pool, config: poolConfig, backends: backends})
+	}
+
+	return updates, nil
+}
+
+// update replaces the configuration and the pools of the room, pools which are
+// not part of the updates are removed.
+func (rm *room) update(config *roomConfig, updates []*poolUpdate) {
+	newPools := make(map[string]*pool)
+	for _, update := range updates {
+		update.pool.update(update.config, update.backends)
+		newPools[update.pool.name] = update.pool
+	}
+
+	rm.atomicConfig.Store(config)
+	rm.atomicPools.Store(newPools)
+}
+
+func (rm *room) config() *roomConfig {
+	return rm.atomicConfig.Load().(*roomConfig)
+}
+
+func (rm *room) pools() map[string]*pool {
+	return rm.atomicPools.Load().(map[string]*pool)
+}
+
+func (rm *room) defaultPool() *pool {
+	return rm.pools()[defaultPoolName]
+}
+
+// routePool returns the pool of the first route matching the request.
+func (rm *room) routePool(r *http.Request) *pool {
+	pools := rm.pools()
+	for _, route := range rm.config().routes {
+		if route.matches(r) {
+			if pool, ok := pools[route.pool]; ok {
+				return pool
+			}
+		}
+	}
+
+	return pools[defaultPoolName]
+}
+
+func (rm *room) syncUpdateSessions() {
+	for _, pool := range rm.pools() {
+		pool.syncUpdateSessions()
+	}
+	rm.tokenUsage.removeExpired()
+	rm.challengeUsage.removeExpired()
+	rm.handshakeUsage.removeExpired()
+}
+
+func (rm *room) countTokenAdmission() {
+	atomic.AddUint64(&rm.tokenAdmissions, 1)
+}
+
+// admitChallenge tells whether the request carries the solution of a challenge
+// which has not been used yet, a new challenge is served otherwise. The
+// solution is only marked as used once it allocates a session.
+func (rm *room) admitChallenge(rw http.ResponseWriter, r *http.Request, pool *pool) bool {
+	config := rm.config().challenge
+	if !config.enabled {
+		return true
+	}
+
+	if _, err := r.Cookie(config.cookieName); err == nil {
+		nonce, _, err := config.verify(r)
+		if err == nil && !rm.challengeUsage.used(nonce) {
+			return true
+		}
+		atomic.AddUint64(&rm.challengesRejected, 1)
+	}
+
+	atomic.AddUint64(&rm.challengesIssued, 1)
+	config.serve(rw, config.difficulty(pool.syncQueuePressure()))
+
+	return false
+}
+
+// newSession allocates a session in the pool and marks the handshake cookie and
+// the challenge solution of the request as used, so that each of them
+// allocates a single session. They are released when no session is allocated
+// so that the client does not have to complete them again.
+func (rm *room) newSession(r *http.Request, pool *pool, client string, binding *sessionBinding, lane string, forceQueue bool) (*session, *backend, bool) {
+	config := rm.config()
+
+	var handshakeNonce string
+	if config.handshake.enabled {
+		nonce, expires, ok := config.handshake.verify(r)
+		if !ok || !rm.handshakeUsage.use(nonce, expires) {
+			return nil, nil, false
+		}
+		handshakeNonce = nonce
+	}
+
+	var challengeNonce string
+	if config.challenge.enabled {
+		nonce, expires, err := config.challenge.verify(r)
+		if err != nil || !rm.challengeUsage.use(nonce, expires) {
+			rm.releaseNonces(handshakeNonce, "")
+			return nil, nil, false
+		}
+		challengeNonce = nonce
+	}
+
+	session, backend, ok := pool.syncNewSession(client, binding, lane, forceQueue)
+	if !ok {
+		rm.releaseNonces(handshakeNonce, challengeNonce)
+	} else if challengeNonce != "" {
+		atomic.AddUint64(&rm.challengesSolved, 1)
+	}
+
+	return session, backend, ok
+}
+
+func (rm *room) releaseNonces(handshakeNonce string, challengeNonce string) {
+	if handshakeNonce != "" {
+		rm.handshakeUsage.release(handshakeNonce)
+	}
+	if challengeNonce != "" {
+		rm.challengeUsage.release(challengeNonce)
+	}
+}
+
+// checkBinding tells whether the client may use the session, the session is
+// removed on mismatch when the binding action is `invalidate`.
+func (rm *room) checkBinding(pool *pool, session *session, clientIP string, userAgent string) bool {
+	config := rm.config().binding
+	if !config.enabled() || session.binding.matches(config, clientIP, userAgent) {
+		return true
+	}
+
+	atomic.AddUint64(&rm.bindingMismatches, 1)
+	if config.action == bindingActionInvalidate {
+		pool.syncRemoveSession(session.id)
+	}
+
+	return false
+}
+
+// resetTraffic sets the traffic statistics of the backends of all pools back
+// to zero.
+func (rm *room) resetTraffic() {
+	for _, pool := range rm.pools() {
+		pool.resetTraffic()
+	}
+}
+
+func (rm *room) syncStatistics() *RoomStatistics {
+	defaultPoolStatistics := rm.defaultPool().syncStatistics()
+	statistics := RoomStatistics{
+		Name:                rm.name,
+		QueuedSessions:      defaultPoolStatistics.QueuedSessions,
+		MaxQueuedSessions:   defaultPoolStatistics.MaxQueuedSessions,
+		QueuedSessionTTL:    defaultPoolStatistics.QueuedSessionTTL,
+		QueuedLanes:         defaultPoolStatistics.QueuedLanes,
+		QueueWaitLanes:      defaultPoolStatistics.QueueWaitLanes,
+		Backends:            defaultPoolStatistics.Backends,
+		Pools:               make([]*PoolStatistics, 0),
+		WhitelistedRequests: defaultPoolStatistics.WhitelistedRequests,
+		BypassedRequests:    defaultPoolStatistics.BypassedRequests,
+		TokenAdmissions:     atomic.LoadUint64(&rm.tokenAdmissions),
+		ChallengesIssued:    atomic.LoadUint64(&rm.challengesIssued),
+		ChallengesSolved:    atomic.LoadUint64(&rm.challengesSolved),
+		ChallengesRejected:  atomic.LoadUint64(&rm.challengesRejected),
+		BindingMismatches:   atomic.LoadUint64(&rm.bindingMismatches),
+	}
+
+	queueWait := newQueueWaitAnalytics()
+	for poolName, pool := range rm.pools() {
+		queueWait.merge(pool.syncQueueWaitTotal())
+		if poolName == defaultPoolName {
+			continue
+		}
+
+		poolStatistics := pool.syncStatistics()
+		statistics.WhitelistedRequests += poolStatistics.WhitelistedRequests
+		statistics.BypassedRequests += poolStatistics.BypassedRequests
+		statistics.Pools = append(statistics.Pools, poolStatistics)
+	}
+	sort.Slice(statistics.Pools, func(i int, j int) bool {
+		return statistics.Pools[i].Name < statistics.Pools[j].Name
+	})
+	statistics.QueueWait = queueWait.statistics()
+
+	return &statistics
+}
+
+func (rm *room) syncInvitationStatistics() *InvitationStatistics {
+	statistics := InvitationStatistics{
+		Codes: rm.invitationUsage.statistics(rm.config().invitations),
+	}
+
+	for _, pool := range rm.pools() {
+		pool.sessionsLock.RLock()
+		for _, backend := range pool.backends() {
+			statistics.ReservedSessions += backend.reservedStore.len()
+		}
+		statistics.RemainingReservations += pool.remainingReservedPlaces()
+		pool.sessionsLock.RUnlock()
+	}
+
+	return &statistics
+}
+
+// roomMatch tells how specifically a room matches a request: an exact host
+// beats a wildcard host, which beats rooms without hosts, longer wildcards beat
+// shorter ones and longer path prefixes break the remaining ties.
+type roomMatch struct {
+	exactHost  bool
+	hostLength int
+	pathLength int
+}
+
+func (m roomMatch) beats(other roomMatch) bool {
+	if m.exactHost != other.exactHost {
+		return m.exactHost
+	}
+	if m.hostLength != other.hostLength {
+		return m.hostLength > other.hostLength
+	}
+
+	return m.pathLength > other.pathLength
+}
+
+func (config *roomConfig) match(r *http.Request) (roomMatch, bool) {
+	match := roomMatch{pathLength: len(config.pathPrefix)}
+	if !strings.HasPrefix(r.URL.Path, config.pathPrefix) {
+		return match, false
+	}
+
+	if len(config.hosts) == 0 {
+		return match, true
+	}
+
+	var hostMatched bool
+	for _, host := range config.hosts {
+		if !matchHost(host, r.Host) {
+			continue
+		}
+		hostMatched = true
+
+		hostMatch := roomMatch{exactHost: !strings.HasPrefix(host, "*."), hostLength: len(host), pathLength: match.pathLength}
+		if hostMatch.beats(match) {
+			match = hostMatch
+		}
+	}
+
+	return match, hostMatched
+}
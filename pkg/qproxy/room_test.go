@@ -0,0 +1,93 @@
+package qproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRooms(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("rooms.shop.hosts", []string{"shop.example.com"})
+	v.Set("rooms.shop.cookie_name", "shop")
+	v.Set("rooms.shop.queue.template", "../../test/template.html")
+	v.Set("rooms.shop.queue.full_template", "../../test/template.html")
+	v.Set("rooms.shop.queue.session_ttl", 5)
+	v.Set("rooms.shop.backends.test.url", "http://"+testBackendAddr)
+	v.Set("rooms.shop.backends.test.max_sessions", 1)
+	v.Set("rooms.shop.backends.test.session_ttl", 5)
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+
+	shop := qp.routeRoom(httptest.NewRequest("GET", "http://shop.example.com/", nil))
+	assert.Equal(t, "shop", shop.name)
+	assert.Equal(t, defaultRoomName, qp.routeRoom(httptest.NewRequest("GET", "http://www.example.com/", nil)).name)
+
+	session, backend, ok := qp.defaultRoom().defaultPool().syncNewSession("", nil, defaultLaneName, false)
+	require.True(t, ok)
+	require.NotNil(t, backend)
+
+	rw := httptest.NewRecorder()
+	newAPIHandler(qp).ServeHTTP(rw, httptest.NewRequest("GET", "/rooms/shop/statistics", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), `"Name":"shop"`)
+
+	v.Set("rooms", map[string]interface{}{})
+	require.NoError(t, qp.config.loadDynamicConfig())
+	require.NoError(t, qp.loadRooms())
+
+	_, ok = qp.room("shop")
+	assert.False(t, ok)
+	_, _, ok = qp.defaultRoom().defaultPool().syncLoadSession(session.id)
+	assert.True(t, ok)
+
+	rw = httptest.NewRecorder()
+	newAPIHandler(qp).ServeHTTP(rw, httptest.NewRequest("GET", "/rooms/shop/statistics", nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
+
+func TestRouteRoomSpecificity(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	for name, options := range map[string]map[string]interface{}{
+		"aaa":  {"hosts": []string{"*.example.com"}},
+		"bbb":  {"hosts": []string{"*.shop.example.com"}},
+		"ccc":  {"hosts": []string{"shop.example.com"}, "path_prefix": "/checkout"},
+		"shop": {"hosts": []string{"shop.example.com"}},
+	} {
+		for key, value := range options {
+			v.Set("rooms."+name+"."+key, value)
+		}
+		v.Set("rooms."+name+".cookie_name", name)
+		v.Set("rooms."+name+".queue.template", "../../test/template.html")
+		v.Set("rooms."+name+".queue.full_template", "../../test/template.html")
+		v.Set("rooms."+name+".backends.test.url", "http://"+testBackendAddr)
+		v.Set("rooms."+name+".queue.session_ttl", 5)
+		v.Set("rooms."+name+".backends.test.max_sessions", 1)
+		v.Set("rooms."+name+".backends.test.session_ttl", 5)
+	}
+	require.NoError(t, ValidateProxyConfig(v))
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+
+	for url, name := range map[string]string{
+		"http://shop.example.com/":          "shop",
+		"http://shop.example.com/checkout":  "ccc",
+		"http://eu.shop.example.com/":       "bbb",
+		"http://www.example.com/":           "aaa",
+		"http://www.example.org/":           defaultRoomName,
+		"http://shop.example.com:8080/cart": "shop",
+	} {
+		assert.Equal(t, name, qp.routeRoom(httptest.NewRequest("GET", url, nil)).name, url)
+	}
+}
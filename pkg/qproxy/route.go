@@ -0,0 +1,89 @@
+package qproxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// routeConfig sends the requests matching a host and a path prefix to a pool,
+// requests matching no route are sent to the default pool.
+type routeConfig struct {
+	host       string
+	pathPrefix string
+	pool       string
+}
+
+type rawRouteConfig struct {
+	Host       string `mapstructure:"host"`
+	PathPrefix string `mapstructure:"path_prefix"`
+	Pool       string `mapstructure:"pool"`
+}
+
+func newRoutesConfig(v *viper.Viper) ([]*routeConfig, error) {
+	rawRoutes := make([]rawRouteConfig, 0)
+	if err := v.UnmarshalKey("routes", &rawRoutes); err != nil {
+		return nil, err
+	}
+
+	routes := make([]*routeConfig, 0)
+	for _, rawRoute := range rawRoutes {
+		routes = append(routes, &routeConfig{
+			host:       strings.ToLower(rawRoute.Host),
+			pathPrefix: rawRoute.PathPrefix,
+			pool:       strings.ToLower(rawRoute.Pool),
+		})
+	}
+
+	return routes, nil
+}
+
+func validateRoutesConfig(v *viper.Viper) error {
+	routes, err := newRoutesConfig(v)
+	if err != nil {
+		return err
+	}
+
+	for _, route := range routes {
+		if route.host == "" && route.pathPrefix == "" {
+			return errors.New("[route] Missing `host` or `path_prefix` option")
+		}
+
+		if route.pool == "" {
+			return errors.New("[route] Missing `pool` option")
+		}
+
+		if _, ok := v.GetStringMap("pools")[route.pool]; !ok && route.pool != defaultPoolName {
+			return errors.New("[route] Unknown pool `" + route.pool + "`")
+		}
+	}
+
+	return nil
+}
+
+func (route *routeConfig) matches(r *http.Request) bool {
+	if route.host != "" && !matchHost(route.host, r.Host) {
+		return false
+	}
+
+	return strings.HasPrefix(r.URL.Path, route.pathPrefix)
+}
+
+// matchHost matches the request host, without its port, against a host name
+// which may start with a `*.` wildcard.
+func matchHost(pattern string, requestHost string) bool {
+	host, _, err := net.SplitHostPort(requestHost)
+	if err != nil {
+		host = requestHost
+	}
+	host = strings.ToLower(host)
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+
+	return host == pattern
+}
@@ -0,0 +1,42 @@
+package qproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchHost(t *testing.T) {
+	assert.True(t, matchHost("shop.example.com", "shop.example.com"))
+	assert.True(t, matchHost("shop.example.com", "SHOP.example.com:8080"))
+	assert.True(t, matchHost("*.example.com", "shop.example.com"))
+	assert.False(t, matchHost("*.example.com", "example.com"))
+	assert.False(t, matchHost("shop.example.com", "blog.example.com"))
+}
+
+func TestRoutePool(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("pools.shop.backends.test.url", "http://"+testBackendAddr)
+	v.Set("pools.shop.backends.test.max_sessions", 1)
+	v.Set("pools.shop.backends.test.session_ttl", 5)
+	v.Set("pools.shop.queue.max_sessions", 10)
+	v.Set("routes", []map[string]interface{}{
+		{"host": "shop.example.com", "pool": "shop"},
+		{"path_prefix": "/checkout", "pool": "shop"},
+	})
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+
+	shop := qp.defaultRoom().routePool(httptest.NewRequest("GET", "http://shop.example.com/", nil))
+	assert.Equal(t, "shop", shop.name)
+	assert.Equal(t, "qpid_shop", shop.config().cookieName)
+	assert.Equal(t, 10, shop.config().maxQueuedSessions)
+	assert.Equal(t, "shop", qp.defaultRoom().routePool(httptest.NewRequest("GET", "http://www.example.com/checkout/cart", nil)).name)
+	assert.Equal(t, defaultPoolName, qp.defaultRoom().routePool(httptest.NewRequest("GET", "http://www.example.com/", nil)).name)
+}
@@ -0,0 +1,446 @@
+package qproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	ruleActionBypass     = "bypass"
+	ruleActionDeny       = "deny"
+	ruleActionForceQueue = "force_queue"
+	ruleActionLane       = "lane"
+)
+
+// ruleContext holds the request being evaluated by the rules
+type ruleContext struct {
+	r        *http.Request
+	clientIP string
+}
+
+type rulePredicate func(ctx *ruleContext) bool
+
+// requestRule applies an action to the requests matching its expression, for
+// example `path startswith "/api" and header["X-Partner"] != ""`.
+type requestRule struct {
+	name       string
+	expression string
+	predicate  rulePredicate
+	action     string
+	lane       string
+}
+
+type rawRequestRule struct {
+	Name   string `mapstructure:"name"`
+	When   string `mapstructure:"when"`
+	Action string `mapstructure:"action"`
+	Lane   string `mapstructure:"lane"`
+}
+
+func newRequestRules(v *viper.Viper) ([]*requestRule, error) {
+	rawRules := make([]rawRequestRule, 0)
+	if err := v.UnmarshalKey("rules", &rawRules); err != nil {
+		return nil, err
+	}
+
+	rules := make([]*requestRule, 0)
+	for i, rawRule := range rawRules {
+		name := rawRule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		predicate, err := compileRuleExpression(rawRule.When)
+		if err != nil {
+			return nil, fmt.Errorf("[rule: %s] %s", name, err)
+		}
+
+		rules = append(rules, &requestRule{
+			name:       name,
+			expression: rawRule.When,
+			predicate:  predicate,
+			action:     rawRule.Action,
+			lane:       rawRule.Lane,
+		})
+	}
+
+	return rules, nil
+}
+
+func validateRequestRules(v *viper.Viper) error {
+	rules, err := newRequestRules(v)
+	if err != nil {
+		return err
+	}
+
+	// Rules apply to the requests of every pool, pools which do not override
+	// their lanes use the ones of the room.
+	lanes := v.GetStringSlice("queue.lanes")
+	poolLanes := make(map[string][]string)
+	for poolName := range v.GetStringMap("pools") {
+		if poolConfig := v.Sub("pools." + poolName); poolConfig != nil && poolConfig.IsSet("queue.lanes") {
+			poolLanes[poolName] = poolConfig.GetStringSlice("queue.lanes")
+		}
+	}
+
+	for _, rule := range rules {
+		switch rule.action {
+		case ruleActionBypass, ruleActionDeny, ruleActionForceQueue:
+		case ruleActionLane:
+			if rule.lane == defaultLaneName {
+				continue
+			}
+			if !containsString(lanes, rule.lane) {
+				return fmt.Errorf("[rule: %s] Unknown lane `%s`", rule.name, rule.lane)
+			}
+			for poolName, lanes := range poolLanes {
+				if !containsString(lanes, rule.lane) {
+					return fmt.Errorf("[rule: %s] Unknown lane `%s` in pool `%s`", rule.name, rule.lane, poolName)
+				}
+			}
+		default:
+			return fmt.Errorf("[rule: %s] Option `action` must be `%s`, `%s`, `%s` or `%s`", rule.name,
+				ruleActionBypass, ruleActionDeny, ruleActionForceQueue, ruleActionLane)
+		}
+	}
+
+	return nil
+}
+
+// matchRequestRule returns the first rule matching the request.
+func matchRequestRule(rules []*requestRule, ctx *ruleContext) (*requestRule, bool) {
+	for _, rule := range rules {
+		if rule.predicate(ctx) {
+			return rule, true
+		}
+	}
+
+	return nil, false
+}
+
+type ruleTokenKind int
+
+const (
+	ruleTokenIdent ruleTokenKind = iota
+	ruleTokenString
+	ruleTokenSymbol
+	ruleTokenEnd
+)
+
+type ruleToken struct {
+	kind  ruleTokenKind
+	value string
+}
+
+func tokenizeRuleExpression(expression string) ([]ruleToken, error) {
+	tokens := make([]ruleToken, 0)
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		char := runes[i]
+		switch {
+		case unicode.IsSpace(char):
+			i++
+		case unicode.IsLetter(char) || char == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, ruleToken{kind: ruleTokenIdent, value: strings.ToLower(string(runes[start:i]))})
+		case char == '"' || char == '\'':
+			var value strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != char; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				return nil, errors.New("Unterminated string")
+			}
+			i++
+			tokens = append(tokens, ruleToken{kind: ruleTokenString, value: value.String()})
+		case strings.ContainsRune("()[],", char):
+			tokens = append(tokens, ruleToken{kind: ruleTokenSymbol, value: string(char)})
+			i++
+		case i+1 < len(runes) && containsString([]string{"==", "!=", "&&", "||"}, string(runes[i:i+2])):
+			tokens = append(tokens, ruleToken{kind: ruleTokenSymbol, value: string(runes[i : i+2])})
+			i += 2
+		case char == '!':
+			tokens = append(tokens, ruleToken{kind: ruleTokenSymbol, value: "!"})
+			i++
+		default:
+			return nil, fmt.Errorf("Unexpected character `%c`", char)
+		}
+	}
+
+	return append(tokens, ruleToken{kind: ruleTokenEnd}), nil
+}
+
+type ruleParser struct {
+	tokens []ruleToken
+	pos    int
+}
+
+// compileRuleExpression compiles an expression made of comparisons combined
+// with `and`, `or`, `not` and parentheses. A comparison is a field (`ip`,
+// `method`, `path`, `host`, `user_agent`, `header["name"]`, `cookie["name"]`
+// or `query["name"]`) followed by an operator (`==`, `!=`, `contains`,
+// `startswith`, `endswith`, `matches` or `in`) and a string or a list of
+// strings. `ip in [...]` accepts IP addresses and CIDRs.
+func compileRuleExpression(expression string) (rulePredicate, error) {
+	if strings.TrimSpace(expression) == "" {
+		return nil, errors.New("Missing `when` option")
+	}
+
+	tokens, err := tokenizeRuleExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := ruleParser{tokens: tokens}
+	predicate, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if token := parser.peek(); token.kind != ruleTokenEnd {
+		return nil, fmt.Errorf("Unexpected `%s`", token.value)
+	}
+
+	return predicate, nil
+}
+
+func (p *ruleParser) peek() ruleToken {
+	return p.tokens[p.pos]
+}
+
+func (p *ruleParser) next() ruleToken {
+	token := p.tokens[p.pos]
+	if token.kind != ruleTokenEnd {
+		p.pos++
+	}
+
+	return token
+}
+
+func (p *ruleParser) accept(values ...string) bool {
+	token := p.peek()
+	if token.kind != ruleTokenIdent && token.kind != ruleTokenSymbol {
+		return false
+	}
+
+	for _, value := range values {
+		if token.value == value {
+			p.pos++
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *ruleParser) expect(value string) error {
+	if !p.accept(value) {
+		return fmt.Errorf("Expected `%s`", value)
+	}
+
+	return nil
+}
+
+func (p *ruleParser) parseOr() (rulePredicate, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("or", "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(ctx *ruleContext) bool { return l(ctx) || right(ctx) }
+	}
+
+	return left, nil
+}
+
+func (p *ruleParser) parseAnd() (rulePredicate, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("and", "&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(ctx *ruleContext) bool { return l(ctx) && right(ctx) }
+	}
+
+	return left, nil
+}
+
+func (p *ruleParser) parseNot() (rulePredicate, error) {
+	if p.accept("not", "!") {
+		predicate, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(ctx *ruleContext) bool { return !predicate(ctx) }, nil
+	}
+
+	if p.accept("(") {
+		predicate, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		return predicate, p.expect(")")
+	}
+
+	return p.parseComparison()
+}
+
+func (p *ruleParser) parseComparison() (rulePredicate, error) {
+	fieldName, field, err := p.parseField()
+	if err != nil {
+		return nil, err
+	}
+
+	operator := p.next()
+	if operator.kind != ruleTokenIdent && operator.kind != ruleTokenSymbol {
+		return nil, errors.New("Expected an operator")
+	}
+
+	if operator.value == "in" {
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+
+		if fieldName == "ip" {
+			ips, err := newIPList(values)
+			if err != nil {
+				return nil, err
+			}
+
+			return func(ctx *ruleContext) bool { return ips.contains(field(ctx)) }, nil
+		}
+
+		return func(ctx *ruleContext) bool { return containsString(values, field(ctx)) }, nil
+	}
+
+	value := p.next()
+	if value.kind != ruleTokenString {
+		return nil, fmt.Errorf("Expected a string after `%s`", operator.value)
+	}
+
+	switch operator.value {
+	case "==":
+		return func(ctx *ruleContext) bool { return field(ctx) == value.value }, nil
+	case "!=":
+		return func(ctx *ruleContext) bool { return field(ctx) != value.value }, nil
+	case "contains":
+		return func(ctx *ruleContext) bool { return strings.Contains(field(ctx), value.value) }, nil
+	case "startswith":
+		return func(ctx *ruleContext) bool { return strings.HasPrefix(field(ctx), value.value) }, nil
+	case "endswith":
+		return func(ctx *ruleContext) bool { return strings.HasSuffix(field(ctx), value.value) }, nil
+	case "matches":
+		pattern, err := regexp.Compile(value.value)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(ctx *ruleContext) bool { return pattern.MatchString(field(ctx)) }, nil
+	}
+
+	return nil, fmt.Errorf("Unknown operator `%s`", operator.value)
+}
+
+func (p *ruleParser) parseField() (string, func(ctx *ruleContext) string, error) {
+	token := p.next()
+	if token.kind != ruleTokenIdent {
+		return "", nil, errors.New("Expected a field")
+	}
+
+	switch token.value {
+	case "ip":
+		return token.value, func(ctx *ruleContext) string { return ctx.clientIP }, nil
+	case "method":
+		return token.value, func(ctx *ruleContext) string { return ctx.r.Method }, nil
+	case "path":
+		return token.value, func(ctx *ruleContext) string { return ctx.r.URL.Path }, nil
+	case "host":
+		return token.value, func(ctx *ruleContext) string { return ctx.r.Host }, nil
+	case "user_agent":
+		return token.value, func(ctx *ruleContext) string { return ctx.r.UserAgent() }, nil
+	case "header", "cookie", "query":
+	default:
+		return "", nil, fmt.Errorf("Unknown field `%s`", token.value)
+	}
+
+	if err := p.expect("["); err != nil {
+		return "", nil, err
+	}
+
+	key := p.next()
+	if key.kind != ruleTokenString {
+		return "", nil, fmt.Errorf("Expected a string after `%s[`", token.value)
+	}
+
+	if err := p.expect("]"); err != nil {
+		return "", nil, err
+	}
+
+	switch token.value {
+	case "header":
+		return token.value, func(ctx *ruleContext) string { return ctx.r.Header.Get(key.value) }, nil
+	case "cookie":
+		return token.value, func(ctx *ruleContext) string {
+			if cookie, err := ctx.r.Cookie(key.value); err == nil {
+				return cookie.Value
+			}
+
+			return ""
+		}, nil
+	}
+
+	return token.value, func(ctx *ruleContext) string { return ctx.r.URL.Query().Get(key.value) }, nil
+}
+
+func (p *ruleParser) parseList() ([]string, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+
+	values := make([]string, 0)
+	for {
+		value := p.next()
+		if value.kind != ruleTokenString {
+			return nil, errors.New("Expected a string in list")
+		}
+		values = append(values, value.value)
+
+		if p.accept("]") {
+			return values, nil
+		}
+
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
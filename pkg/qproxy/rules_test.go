@@ -0,0 +1,80 @@
+package qproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleExpression(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://shop.example.com/api/orders?campaign=spring", nil)
+	r.Header.Set("User-Agent", "curl/7.68.0")
+	r.Header.Set("X-Partner", "acme")
+	r.AddCookie(&http.Cookie{Name: "vip", Value: "1"})
+	ctx := &ruleContext{r: r, clientIP: "10.1.2.3"}
+
+	expressions := map[string]bool{
+		`ip in ["10.0.0.0/8", "192.168.1.1"]`:                       true,
+		`ip in ["192.168.1.1"]`:                                     false,
+		`method == "POST" and path startswith "/api"`:               true,
+		`host endswith ".example.com" && !(method == "GET")`:        true,
+		`user_agent contains "curl" or header["X-Bot"] == "1"`:      true,
+		`header["x-partner"] in ["acme", "globex"]`:                 true,
+		`cookie["vip"] == '1' and query["campaign"] matches "^spr"`: true,
+		`not cookie["missing"] != ""`:                               true,
+		`query["campaign"] == "summer"`:                             false,
+	}
+
+	for expression, expected := range expressions {
+		predicate, err := compileRuleExpression(expression)
+		require.NoError(t, err, expression)
+		assert.Equal(t, expected, predicate(ctx), expression)
+	}
+}
+
+func TestInvalidRuleExpression(t *testing.T) {
+	errors := map[string]string{
+		``:                        "Missing `when` option",
+		`path`:                    "Expected an operator",
+		`path == `:                "Expected a string after `==`",
+		`agent == "curl"`:         "Unknown field `agent`",
+		`path like "/api"`:        "Unknown operator `like`",
+		`(path == "/"`:            "Expected `)`",
+		`path == "/" path`:        "Unexpected `path`",
+		`path == "/`:              "Unterminated string",
+		`ip in ["not an ip"]`:     "Invalid IP: not an ip",
+		`header == "foo"`:         "Expected `[`",
+		`path matches "("`:        "error parsing regexp: missing closing ): `(`",
+		`method in ["GET" "PUT"]`: "Expected `,`",
+	}
+
+	for expression, expected := range errors {
+		_, err := compileRuleExpression(expression)
+		assert.EqualError(t, err, expected, expression)
+	}
+}
+
+func TestRequestRulesConfig(t *testing.T) {
+	v := viper.New()
+	v.Set("rules", []map[string]interface{}{{"when": `path == "/"`, "action": "allow"}})
+	assert.EqualError(t, validateRequestRules(v), "[rule: #1] Option `action` must be `bypass`, `deny`, `force_queue` or `lane`")
+
+	v.Set("rules", []map[string]interface{}{{"name": "vip", "when": `cookie["vip"] == "1"`, "action": "lane", "lane": "priority"}})
+	assert.EqualError(t, validateRequestRules(v), "[rule: vip] Unknown lane `priority`")
+
+	v.Set("queue.lanes", []string{"priority"})
+	assert.NoError(t, validateRequestRules(v))
+
+	v.Set("pools.api.queue.lanes", []string{"partner"})
+	assert.EqualError(t, validateRequestRules(v), "[rule: vip] Unknown lane `priority` in pool `api`")
+
+	v.Set("pools.api.queue.lanes", []string{"partner", "priority"})
+	assert.NoError(t, validateRequestRules(v))
+
+	v.Set("rules", []map[string]interface{}{{"name": "broken", "when": `path ==`, "action": "deny"}})
+	assert.EqualError(t, validateRequestRules(v), "[rule: broken] Expected a string after `==`")
+}
@@ -0,0 +1,99 @@
+package qproxy
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	scheduleOutsideBypass = "bypass"
+	scheduleOutsideClosed = "closed"
+)
+
+// scheduleConfig limits the queue of a room to a time window, a zero start or
+// end leaves the window open on that side. Outside of the window requests
+// bypass the queue, or are served the closed template.
+type scheduleConfig struct {
+	start          time.Time
+	end            time.Time
+	outside        string
+	closedTemplate *template.Template
+}
+
+func newScheduleConfig(v *viper.Viper) (*scheduleConfig, error) {
+	config := scheduleConfig{outside: v.GetString("schedule.outside")}
+	if config.outside == "" {
+		config.outside = scheduleOutsideBypass
+	}
+
+	var err error
+	if start := v.GetString("schedule.start"); start != "" {
+		if config.start, err = time.Parse(time.RFC3339, start); err != nil {
+			return nil, err
+		}
+	}
+
+	if end := v.GetString("schedule.end"); end != "" {
+		if config.end, err = time.Parse(time.RFC3339, end); err != nil {
+			return nil, err
+		}
+	}
+
+	if v.GetString("schedule.closed_template") != "" {
+		config.closedTemplate, err = template.ParseFiles(v.GetString("schedule.closed_template"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &config, nil
+}
+
+func validateScheduleConfig(v *viper.Viper) error {
+	outside := v.GetString("schedule.outside")
+	if outside != "" && outside != scheduleOutsideBypass && outside != scheduleOutsideClosed {
+		return fmt.Errorf("Option `schedule.outside` must be `%s` or `%s`", scheduleOutsideBypass, scheduleOutsideClosed)
+	}
+
+	var start, end time.Time
+	for _, option := range []struct {
+		key   string
+		value *time.Time
+	}{{"schedule.start", &start}, {"schedule.end", &end}} {
+		if v.GetString(option.key) == "" {
+			continue
+		}
+
+		value, err := time.Parse(time.RFC3339, v.GetString(option.key))
+		if err != nil {
+			return fmt.Errorf("Option `%s` must be an RFC 3339 time", option.key)
+		}
+		*option.value = value
+	}
+
+	if !start.IsZero() && !end.IsZero() && !end.After(start) {
+		return errors.New("Option `schedule.end` must be after `schedule.start`")
+	}
+
+	return nil
+}
+
+// active tells whether the queue of the room is open at the given time.
+func (config *scheduleConfig) active(now time.Time) bool {
+	return (config.start.IsZero() || !now.Before(config.start)) && (config.end.IsZero() || now.Before(config.end))
+}
+
+func (config *scheduleConfig) serveClosed(rw http.ResponseWriter) {
+	if config.closedTemplate == nil {
+		http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	config.closedTemplate.Execute(rw, nil)
+}
@@ -0,0 +1,74 @@
+package qproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleConfig(t *testing.T) {
+	v := newViper()
+	v.Set("schedule.outside", "open")
+	assert.EqualError(t, validateScheduleConfig(v), "Option `schedule.outside` must be `bypass` or `closed`")
+
+	v.Set("schedule.outside", scheduleOutsideClosed)
+	v.Set("schedule.start", "tomorrow")
+	assert.EqualError(t, validateScheduleConfig(v), "Option `schedule.start` must be an RFC 3339 time")
+
+	v.Set("schedule.start", "2026-10-18T10:00:00Z")
+	v.Set("schedule.end", "2026-10-18T09:00:00Z")
+	assert.EqualError(t, validateScheduleConfig(v), "Option `schedule.end` must be after `schedule.start`")
+
+	v.Set("schedule.end", "2026-10-18T12:00:00Z")
+	require.NoError(t, validateScheduleConfig(v))
+
+	config, err := newScheduleConfig(v)
+	require.NoError(t, err)
+	assert.False(t, config.active(time.Date(2026, 10, 18, 9, 59, 0, 0, time.UTC)))
+	assert.True(t, config.active(time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)))
+	assert.False(t, config.active(time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)))
+	assert.True(t, (&scheduleConfig{}).active(time.Now()))
+}
+
+func TestRoomSchedule(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	v := newViper()
+	v.Set("backends.test.url", upstream.URL)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("schedule.start", time.Now().Add(time.Hour).Format(time.RFC3339))
+	v.Set("rooms.shop.hosts", []string{"shop.example.com"})
+	v.Set("rooms.shop.cookie_name", "shop")
+	v.Set("rooms.shop.queue.template", "../../test/template.html")
+	v.Set("rooms.shop.queue.full_template", "../../test/template.html")
+	v.Set("rooms.shop.queue.session_ttl", 5)
+	v.Set("rooms.shop.backends.test.url", upstream.URL)
+	v.Set("rooms.shop.backends.test.max_sessions", 1)
+	v.Set("rooms.shop.backends.test.session_ttl", 5)
+	v.Set("rooms.shop.schedule.end", time.Now().Add(-time.Hour).Format(time.RFC3339))
+	v.Set("rooms.shop.schedule.outside", scheduleOutsideClosed)
+	require.NoError(t, ValidateProxyConfig(v))
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	handler := newProxyHandler(qp)
+
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("GET", "http://www.example.com/", nil))
+		assert.Equal(t, "ok", rw.Body.String())
+	}
+	assert.Equal(t, 0, qp.defaultRoom().defaultPool().syncStatistics().QueuedSessions)
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "http://shop.example.com/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+}
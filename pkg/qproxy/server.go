@@ -22,6 +22,7 @@ func (qp *QProxy) ListenAndServe() {
 	go qp.handleSessionUpdate()
 	go qp.handleShutdownSignal()
 	go qp.handleConfigurationReloadSignal()
+	go qp.handleReopenSignal()
 	go qp.serveAPI()
 
 	qp.serveProxy()
@@ -34,13 +35,14 @@ func (qp *QProxy) Shutdown(ctx context.Context) {
 		return
 	}
 
-	log.Info("QProxy server is shutting down....")
+	proxyLog.Info("QProxy server is shutting down....")
+	qp.events.shutdown()
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 	go func() {
 		if qp.server != nil {
 			if err := qp.server.Shutdown(ctx); err != nil {
-				log.WithFields(log.Fields{"error": err}).Warning("Could not gracefully shutdown QProxy server")
+				proxyLog.WithFields(log.Fields{"error": err}).Warning("Could not gracefully shutdown QProxy server")
 			}
 		}
 
@@ -49,7 +51,7 @@ func (qp *QProxy) Shutdown(ctx context.Context) {
 	go func() {
 		if qp.apiServer != nil {
 			if err := qp.apiServer.Shutdown(ctx); err != nil {
-				log.WithFields(log.Fields{"error": err}).Warning("Could not gracefully shutdown Api server")
+				apiLog.WithFields(log.Fields{"error": err}).Warning("Could not gracefully shutdown Api server")
 			}
 		}
 
@@ -57,6 +59,8 @@ func (qp *QProxy) Shutdown(ctx context.Context) {
 	}()
 
 	wg.Wait()
+	// Spans of the requests served until then are sent
+	qp.tracer.shutdown()
 	close(qp.doneChan)
 }
 
@@ -87,6 +91,30 @@ func (qp *QProxy) handleConfigurationReloadSignal() {
 	}
 }
 
+func (qp *QProxy) handleReopenSignal() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for {
+		select {
+		case <-sighup:
+			if err := reopenLogging(); err != nil {
+				configLog.WithFields(log.Fields{"error": err}).Error("Unable to reopen log file")
+			}
+			if err := qp.accessLog.reopen(); err != nil {
+				proxyLog.WithFields(log.Fields{"error": err}).Error("Unable to reopen access log")
+			}
+			if err := qp.history.reopen(); err != nil {
+				apiLog.WithFields(log.Fields{"error": err}).Error("Unable to reopen statistics history file")
+			}
+			if err := qp.events.reopen(); err != nil {
+				proxyLog.WithFields(log.Fields{"error": err}).Error("Unable to reopen events file")
+			}
+		case <-qp.doneChan:
+			return
+		}
+	}
+}
+
 func (qp *QProxy) serveProxy() {
 	addr := qp.config.getString("addr")
 	certFile := qp.config.getString("tls.cert_file")
@@ -99,15 +127,15 @@ func (qp *QProxy) serveProxy() {
 
 	var err error
 	if certFile == "" && keyFile == "" {
-		log.WithFields(log.Fields{"protocol": "http", "addr": addr}).Info("QProxy started")
+		proxyLog.WithFields(log.Fields{"protocol": "http", "addr": addr}).Info("QProxy started")
 		err = qp.server.ListenAndServe()
 	} else {
-		log.WithFields(log.Fields{"protocol": "https", "addr": addr}).Info("QProxy started")
+		proxyLog.WithFields(log.Fields{"protocol": "https", "addr": addr}).Info("QProxy started")
 		err = qp.server.ListenAndServeTLS(certFile, keyFile)
 	}
 
 	if err != http.ErrServerClosed {
-		log.WithFields(log.Fields{"error": err}).Fatal("Proxy server error")
+		proxyLog.WithFields(log.Fields{"error": err}).Fatal("Proxy server error")
 	}
 }
 
@@ -122,14 +150,14 @@ func (qp *QProxy) serveAPI() {
 
 	var err error
 	if certFile == "" && keyFile == "" {
-		log.WithFields(log.Fields{"protocol": "http", "addr": addr}).Info("Api started")
+		apiLog.WithFields(log.Fields{"protocol": "http", "addr": addr}).Info("Api started")
 		err = qp.apiServer.ListenAndServe()
 	} else {
-		log.WithFields(log.Fields{"protocol": "https", "addr": addr}).Info("Api started")
+		apiLog.WithFields(log.Fields{"protocol": "https", "addr": addr}).Info("Api started")
 		err = qp.apiServer.ListenAndServeTLS(certFile, keyFile)
 	}
 
 	if err != http.ErrServerClosed {
-		log.WithFields(log.Fields{"error": err}).Error("Api server error")
+		apiLog.WithFields(log.Fields{"error": err}).Error("Api server error")
 	}
 }
@@ -6,19 +6,63 @@ import (
 )
 
 type session struct {
+	admitted         int64
+	lastSeen         int64
 	id               string
+	whitelisted      bool
+	lane             string
+	client           string
+	binding          *sessionBinding
+	created          time.Time
 	atomicExpiration atomic.Value
 }
 
 func newSession(id string, ttl time.Duration) *session {
-	s := session{id: id}
+	s := session{id: id, created: time.Now()}
 	s.update(ttl)
 
 	return &s
 }
 
+// update extends the lifetime of the session and records the time it was last
+// seen.
 func (s *session) update(ttl time.Duration) {
-	s.atomicExpiration.Store(time.Now().Add(ttl))
+	now := time.Now()
+	atomic.StoreInt64(&s.lastSeen, now.UnixNano())
+	s.atomicExpiration.Store(now.Add(ttl))
+}
+
+func (s *session) lastSeenAt() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastSeen))
+}
+
+// admit records the admission time of the session and returns the time it
+// spent in the queue since its creation.
+func (s *session) admit() time.Duration {
+	now := time.Now()
+	atomic.StoreInt64(&s.admitted, now.UnixNano())
+
+	return now.Sub(s.created)
+}
+
+// admittedAt returns the admission time of the session, the zero time while
+// it is queued.
+func (s *session) admittedAt() time.Time {
+	admitted := atomic.LoadInt64(&s.admitted)
+	if admitted == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, admitted)
+}
+
+func (s *session) queueWait() time.Duration {
+	admitted := s.admittedAt()
+	if admitted.IsZero() {
+		return 0
+	}
+
+	return admitted.Sub(s.created)
 }
 
 func (s *session) expiration() time.Time {
@@ -53,16 +97,33 @@ func (store *sessionStore) store(session *session) *session {
 	return session
 }
 
-func (store *sessionStore) removeExpired() {
+func (store *sessionStore) remove(id string) bool {
+	for i, s := range store.sessions {
+		if s.id == id {
+			copy(store.sessions[i:], store.sessions[i+1:])
+			store.sessions[len(store.sessions)-1] = nil
+			store.sessions = store.sessions[:len(store.sessions)-1]
+			return true
+		}
+	}
+
+	return false
+}
+
+// removeExpired removes the expired sessions and returns them.
+func (store *sessionStore) removeExpired() []*session {
 	if len(store.sessions) == 0 {
-		return
+		return nil
 	}
 
 	sessions := store.sessions[:0]
+	removed := make([]*session, 0)
 	now := time.Now()
 	for _, session := range store.sessions {
 		if session.expiration().After(now) {
 			sessions = append(sessions, session)
+		} else {
+			removed = append(removed, session)
 		}
 	}
 
@@ -71,6 +132,8 @@ func (store *sessionStore) removeExpired() {
 	}
 
 	store.sessions = sessions
+
+	return removed
 }
 
 func (store *sessionStore) pop(size int) []*session {
@@ -92,6 +155,17 @@ func (store *sessionStore) unshift(s *session) bool {
 	return true
 }
 
+func (store *sessionStore) countWhitelisted() int {
+	count := 0
+	for _, s := range store.sessions {
+		if s.whitelisted {
+			count++
+		}
+	}
+
+	return count
+}
+
 func (store *sessionStore) len() int {
 	return len(store.sessions)
 }
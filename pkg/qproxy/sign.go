@@ -0,0 +1,37 @@
+package qproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// signValue appends an HMAC-SHA256 signature of the value, the value must not
+// contain dots.
+func signValue(secret []byte, value string) string {
+	return value + "." + signature(secret, value)
+}
+
+// verifySignedValue checks the signature of a value signed by signValue and
+// returns the value.
+func verifySignedValue(secret []byte, signed string) (string, bool) {
+	idx := strings.LastIndex(signed, ".")
+	if idx < 0 {
+		return "", false
+	}
+
+	value := signed[:idx]
+	if !hmac.Equal([]byte(signed[idx+1:]), []byte(signature(secret, value))) {
+		return "", false
+	}
+
+	return value, true
+}
+
+func signature(secret []byte, value string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(value))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
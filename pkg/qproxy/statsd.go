@@ -0,0 +1,241 @@
+package qproxy
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spf13/viper"
+)
+
+const statsdMetricPrefix = "qproxy_"
+
+type statsdConfig struct {
+	addr          string
+	prefix        string
+	tags          []string
+	dogstatsd     bool
+	maxPacketSize int
+}
+
+func newStatsdConfig(v *viper.Viper) *statsdConfig {
+	v.SetDefault("statsd.max_packet_size", 1432)
+
+	return &statsdConfig{
+		addr:          v.GetString("statsd.addr"),
+		prefix:        v.GetString("statsd.prefix"),
+		tags:          v.GetStringSlice("statsd.tags"),
+		dogstatsd:     v.GetBool("statsd.dogstatsd"),
+		maxPacketSize: v.GetInt("statsd.max_packet_size"),
+	}
+}
+
+func validateStatsdConfig(v *viper.Viper) error {
+	if v.IsSet("statsd.max_packet_size") && v.GetInt("statsd.max_packet_size") <= 0 {
+		return errors.New("Option `statsd.max_packet_size` must be greater than 0")
+	}
+
+	if v.IsSet("statsd.tags") && !v.GetBool("statsd.dogstatsd") {
+		return errors.New("Option `statsd.tags` requires `statsd.dogstatsd`")
+	}
+
+	return nil
+}
+
+// statsdExporter pushes the qproxy Prometheus metrics to a StatsD server over
+// UDP: gauges as gauges, counters as the increments since the previous push
+// and histograms as a timer of the mean of the observations since the previous
+// push, with a counter of these observations.
+type statsdExporter struct {
+	lock     sync.Mutex
+	config   *statsdConfig
+	conn     net.Conn
+	previous map[string]float64
+}
+
+func newStatsdExporter() *statsdExporter {
+	return &statsdExporter{config: &statsdConfig{}, previous: make(map[string]float64)}
+}
+
+// configure applies a new configuration, the connection is opened again when
+// the address changes.
+func (e *statsdExporter) configure(config *statsdConfig) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.conn != nil && e.config.addr != config.addr {
+		e.conn.Close()
+		e.conn = nil
+	}
+
+	if e.conn == nil && config.addr != "" {
+		conn, err := net.Dial("udp", config.addr)
+		if err != nil {
+			return err
+		}
+		e.conn = conn
+	}
+	e.config = config
+
+	return nil
+}
+
+func (e *statsdExporter) enabled() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.conn != nil
+}
+
+// push gathers the metrics and sends them, lines are grouped in packets of at
+// most maxPacketSize bytes.
+func (e *statsdExporter) push(gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.conn == nil {
+		return nil
+	}
+
+	lines := make([]string, 0)
+	current := make(map[string]float64, len(e.previous))
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), statsdMetricPrefix) {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			lines = append(lines, e.lines(family, metric, current)...)
+		}
+	}
+	// Series which no longer exist, such as the ones of removed pools, are
+	// forgotten.
+	e.previous = current
+
+	return e.send(lines)
+}
+
+func (e *statsdExporter) lines(family *dto.MetricFamily, metric *dto.Metric, current map[string]float64) []string {
+	name, tags := e.name(family.GetName(), metric.GetLabel())
+	key := name + tags
+
+	switch family.GetType() {
+	case dto.MetricType_GAUGE:
+		return []string{e.line(name, formatStatsdValue(metric.GetGauge().GetValue()), "g", tags)}
+	case dto.MetricType_COUNTER:
+		delta := e.delta(current, key, metric.GetCounter().GetValue())
+		if delta == 0 {
+			return nil
+		}
+
+		return []string{e.line(name, formatStatsdValue(delta), "c", tags)}
+	case dto.MetricType_HISTOGRAM:
+		histogram := metric.GetHistogram()
+		count := e.delta(current, key+"|count", float64(histogram.GetSampleCount()))
+		sum := e.delta(current, key+"|sum", histogram.GetSampleSum())
+		if count == 0 {
+			return nil
+		}
+
+		return []string{
+			e.line(name, formatStatsdValue(sum/count*1000), "ms", tags),
+			e.line(name+".count", formatStatsdValue(count), "c", tags),
+		}
+	}
+
+	return nil
+}
+
+// name returns the metric name and the DogStatsD tags of the labels, label
+// values are appended to the name when DogStatsD tags are disabled.
+func (e *statsdExporter) name(name string, labels []*dto.LabelPair) (string, string) {
+	labels = append([]*dto.LabelPair(nil), labels...)
+	sort.Slice(labels, func(i int, j int) bool {
+		return labels[i].GetName() < labels[j].GetName()
+	})
+
+	if !e.config.dogstatsd {
+		parts := []string{e.config.prefix + name}
+		for _, label := range labels {
+			parts = append(parts, sanitizeStatsdName(label.GetValue()))
+		}
+
+		return strings.Join(parts, "."), ""
+	}
+
+	tags := append([]string(nil), e.config.tags...)
+	for _, label := range labels {
+		tags = append(tags, label.GetName()+":"+strings.NewReplacer("|", "_", ",", "_").Replace(label.GetValue()))
+	}
+	if len(tags) == 0 {
+		return e.config.prefix + name, ""
+	}
+
+	return e.config.prefix + name, "|#" + strings.Join(tags, ",")
+}
+
+func (e *statsdExporter) line(name string, value string, metricType string, tags string) string {
+	return name + ":" + value + "|" + metricType + tags
+}
+
+// delta records the value of a counter for the current push and returns its
+// increase since the previous push. The first value of a counter is only used
+// as a baseline, counters which have been reset count from zero.
+func (e *statsdExporter) delta(current map[string]float64, key string, value float64) float64 {
+	current[key] = value
+	previous, ok := e.previous[key]
+	if !ok {
+		return 0
+	}
+	if value < previous {
+		return value
+	}
+
+	return value - previous
+}
+
+func (e *statsdExporter) send(lines []string) error {
+	packet := bytes.Buffer{}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > e.config.maxPacketSize {
+			if _, err := e.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	if packet.Len() == 0 {
+		return nil
+	}
+
+	_, err := e.conn.Write(packet.Bytes())
+
+	return err
+}
+
+func formatStatsdValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// sanitizeStatsdName replaces the characters which have a meaning in the
+// StatsD protocol.
+func sanitizeStatsdName(value string) string {
+	return strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_").Replace(value)
+}
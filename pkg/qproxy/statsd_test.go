@@ -0,0 +1,118 @@
+package qproxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listenStatsd(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+
+	return conn
+}
+
+// readStatsd returns the lines of the packets received until the listener is
+// idle.
+func readStatsd(t *testing.T, conn *net.UDPConn) []string {
+	lines := make([]string, 0)
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return lines
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+}
+
+func TestStatsdExporter(t *testing.T) {
+	listener := listenStatsd(t)
+	defer listener.Close()
+
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("statsd.addr", listener.LocalAddr().String())
+	v.Set("statsd.prefix", "edge.")
+	v.Set("statsd.tags", []string{"env:test"})
+	assert.EqualError(t, ValidateProxyConfig(v), "Option `statsd.tags` requires `statsd.dogstatsd`")
+
+	v.Set("statsd.dogstatsd", true)
+	require.NoError(t, ValidateProxyConfig(v))
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+
+	qp.pushStatsd()
+	lines := readStatsd(t, listener)
+	assert.Contains(t, lines, "edge.qproxy_queued_sessions:0|g|#env:test,lane:default,pool:default,room:default")
+	for _, line := range lines {
+		assert.False(t, strings.Contains(line, "|c"), line)
+	}
+
+	pool := qp.defaultRoom().defaultPool()
+	for i := 0; i < 3; i++ {
+		_, _, ok := pool.syncNewSession("", nil, defaultLaneName, false)
+		require.True(t, ok)
+	}
+	pool.countQueueFull()
+
+	qp.pushStatsd()
+	lines = readStatsd(t, listener)
+	assert.Contains(t, lines, "edge.qproxy_admissions_total:1|c|#env:test,pool:default,room:default")
+	assert.Contains(t, lines, "edge.qproxy_queue_full_rejections_total:1|c|#env:test,pool:default,room:default")
+	assert.Contains(t, lines, "edge.qproxy_queued_sessions:2|g|#env:test,lane:default,pool:default,room:default")
+	assert.Contains(t, lines, "edge.qproxy_admitted_sessions:1|g|#env:test,backend:test,pool:default,room:default")
+	for _, line := range lines {
+		assert.False(t, strings.HasPrefix(line, "edge.go_"), line)
+	}
+
+	pool.syncRemoveSession(pool.backends()[0].sessionStore.sessions[0].id)
+	pool.syncUpdateSessions()
+	qp.pushStatsd()
+	lines = readStatsd(t, listener)
+	assert.Contains(t, lines, "edge.qproxy_admissions_total:1|c|#env:test,pool:default,room:default")
+	assert.NotContains(t, lines, "edge.qproxy_queue_full_rejections_total:1|c|#env:test,pool:default,room:default")
+	assert.NotContains(t, lines, "edge.qproxy_queue_wait_seconds.count:1|c|#env:test,lane:default,pool:default,room:default")
+
+	pool.syncRemoveSession(pool.backends()[0].sessionStore.sessions[0].id)
+	pool.syncUpdateSessions()
+	qp.pushStatsd()
+	lines = readStatsd(t, listener)
+	assert.Contains(t, lines, "edge.qproxy_queue_wait_seconds.count:1|c|#env:test,lane:default,pool:default,room:default")
+}
+
+func TestStatsdExporterPlainNames(t *testing.T) {
+	listener := listenStatsd(t)
+	defer listener.Close()
+
+	exporter := newStatsdExporter()
+	require.NoError(t, exporter.configure(&statsdConfig{
+		addr:          listener.LocalAddr().String(),
+		maxPacketSize: 64,
+	}))
+
+	v := newViper()
+	v.Set("backends.test.url", "http://"+testBackendAddr)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	exporter.previous["qproxy_removed_total.test"] = 1
+	require.NoError(t, exporter.push(qp.metrics.registry))
+
+	lines := readStatsd(t, listener)
+	assert.Contains(t, lines, "qproxy_backend_max_sessions.test.default.default:1|g")
+	for _, line := range lines {
+		assert.True(t, len(line) <= 64, line)
+	}
+	assert.NotContains(t, exporter.previous, "qproxy_removed_total.test")
+}
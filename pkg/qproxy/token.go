@@ -0,0 +1,181 @@
+package qproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/spf13/viper"
+)
+
+// bypassToken admits its holders directly, without going through the queue
+type bypassToken struct {
+	ID      string `json:"id"`
+	Expires int64  `json:"exp"`
+	MaxUses int    `json:"uses,omitempty"`
+	Backend string `json:"backend,omitempty"`
+}
+
+type bypassTokensConfig struct {
+	secret []byte
+	param  string
+	header string
+}
+
+func newBypassTokensConfig(v *viper.Viper) *bypassTokensConfig {
+	v.SetDefault("bypass_tokens.param", "qp_token")
+	v.SetDefault("bypass_tokens.header", "X-QProxy-Token")
+
+	return &bypassTokensConfig{
+		secret: []byte(v.GetString("bypass_tokens.secret")),
+		param:  v.GetString("bypass_tokens.param"),
+		header: v.GetString("bypass_tokens.header"),
+	}
+}
+
+// MintBypassToken creates a signed token admitting its holders directly until
+// it expires. Set maxUses to 0 to allow an unlimited number of admissions and
+// backend to an empty string to let QProxy choose the backend.
+func MintBypassToken(secret string, ttl time.Duration, maxUses int, backend string) (string, error) {
+	if secret == "" {
+		return "", errors.New("Missing bypass tokens secret")
+	}
+
+	payload, err := json.Marshal(bypassToken{
+		ID:      xid.New().String(),
+		Expires: time.Now().Add(ttl).Unix(),
+		MaxUses: maxUses,
+		Backend: backend,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return signValue([]byte(secret), base64.RawURLEncoding.EncodeToString(payload)), nil
+}
+
+func parseBypassToken(secret []byte, signed string) (*bypassToken, error) {
+	value, ok := verifySignedValue(secret, signed)
+	if !ok {
+		return nil, errors.New("Invalid bypass token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var token bypassToken
+	if err := json.Unmarshal(payload, &token); err != nil {
+		return nil, err
+	}
+
+	if time.Now().Unix() > token.Expires {
+		return nil, errors.New("Expired bypass token")
+	}
+
+	return &token, nil
+}
+
+// extractBypassToken removes the bypass token from the request query and
+// headers, so it is not forwarded to the backend, and returns it.
+func (config *bypassTokensConfig) extractBypassToken(r *http.Request) (string, bool) {
+	if len(config.secret) == 0 {
+		return "", false
+	}
+
+	signed := r.Header.Get(config.header)
+	r.Header.Del(config.header)
+
+	if rawQuery, value := removeQueryParam(r.URL.RawQuery, config.param); value != "" {
+		signed = value
+		r.URL.RawQuery = rawQuery
+		r.RequestURI = r.URL.RequestURI()
+		accessLogEntryFromContext(r.Context()).setURI(r.RequestURI)
+	}
+
+	return signed, signed != ""
+}
+
+// removeQueryParam removes a parameter from a raw query and returns the query
+// with its first value, the other parameters are kept byte for byte. The query
+// is returned unchanged when the parameter has no value.
+func removeQueryParam(rawQuery string, name string) (string, string) {
+	var value string
+	var found bool
+	kept := make([]string, 0)
+	for _, segment := range strings.Split(rawQuery, "&") {
+		key, rawValue := segment, ""
+		if i := strings.Index(segment, "="); i >= 0 {
+			key, rawValue = segment[:i], segment[i+1:]
+		}
+
+		if key, err := url.QueryUnescape(key); err != nil || key != name {
+			kept = append(kept, segment)
+			continue
+		}
+
+		if !found {
+			found = true
+			value, _ = url.QueryUnescape(rawValue)
+		}
+	}
+
+	if value == "" {
+		return rawQuery, ""
+	}
+
+	return strings.Join(kept, "&"), value
+}
+
+type tokenUses struct {
+	count   int
+	expires time.Time
+}
+
+// tokenUsage counts the admissions of each bypass token until it expires
+type tokenUsage struct {
+	lock sync.Mutex
+	uses map[string]*tokenUses
+}
+
+func newTokenUsage() *tokenUsage {
+	return &tokenUsage{uses: make(map[string]*tokenUses)}
+}
+
+// use records an admission, it fails when the token has been used too many
+// times.
+func (u *tokenUsage) use(token *bypassToken) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	uses, ok := u.uses[token.ID]
+	if !ok {
+		uses = &tokenUses{expires: time.Unix(token.Expires, 0)}
+		u.uses[token.ID] = uses
+	}
+
+	if token.MaxUses > 0 && uses.count >= token.MaxUses {
+		return false
+	}
+	uses.count++
+
+	return true
+}
+
+func (u *tokenUsage) removeExpired() {
+	u.lock.Lock()
+	now := time.Now()
+	for id, uses := range u.uses {
+		if uses.expires.Before(now) {
+			delete(u.uses, id)
+		}
+	}
+	u.lock.Unlock()
+}
@@ -0,0 +1,111 @@
+package qproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBypassToken(t *testing.T) {
+	_, err := MintBypassToken("", time.Hour, 1, "")
+	assert.EqualError(t, err, "Missing bypass tokens secret")
+
+	signed, err := MintBypassToken("secret", time.Hour, 1, "app")
+	require.NoError(t, err)
+
+	token, err := parseBypassToken([]byte("secret"), signed)
+	require.NoError(t, err)
+	assert.Equal(t, "app", token.Backend)
+	assert.Equal(t, 1, token.MaxUses)
+
+	_, err = parseBypassToken([]byte("other"), signed)
+	assert.EqualError(t, err, "Invalid bypass token signature")
+
+	expired, err := MintBypassToken("secret", -time.Hour, 1, "")
+	require.NoError(t, err)
+	_, err = parseBypassToken([]byte("secret"), expired)
+	assert.EqualError(t, err, "Expired bypass token")
+
+	usage := newTokenUsage()
+	assert.True(t, usage.use(token))
+	assert.False(t, usage.use(token))
+}
+
+func TestExtractBypassToken(t *testing.T) {
+	config := &bypassTokensConfig{secret: []byte("secret"), param: "qp_token", header: "X-QProxy-Token"}
+
+	r := httptest.NewRequest("GET", "/promo?qp_token=abc&page=2", nil)
+	signed, ok := config.extractBypassToken(r)
+	assert.True(t, ok)
+	assert.Equal(t, "abc", signed)
+	assert.Equal(t, "page=2", r.URL.RawQuery)
+	assert.Equal(t, "/promo?page=2", r.RequestURI)
+
+	r = httptest.NewRequest("GET", "/promo?b=%7E&qp_token=a%2Bc&a=1&b=2&qp_token=def", nil)
+	signed, ok = config.extractBypassToken(r)
+	assert.True(t, ok)
+	assert.Equal(t, "a+c", signed)
+	assert.Equal(t, "b=%7E&a=1&b=2", r.URL.RawQuery)
+
+	r = httptest.NewRequest("GET", "/promo?qp_token=&page=2", nil)
+	_, ok = config.extractBypassToken(r)
+	assert.False(t, ok)
+	assert.Equal(t, "qp_token=&page=2", r.URL.RawQuery)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-QProxy-Token", "def")
+	signed, ok = config.extractBypassToken(r)
+	assert.True(t, ok)
+	assert.Equal(t, "def", signed)
+	assert.Empty(t, r.Header.Get("X-QProxy-Token"))
+
+	_, ok = config.extractBypassToken(httptest.NewRequest("GET", "/", nil))
+	assert.False(t, ok)
+}
+
+func TestBypassTokenStrippedOnBypass(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	received := make(chan *http.Request, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		received <- r
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(dir, "access.log")
+	v := newViper()
+	v.Set("backends.test.url", upstream.URL)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("access_log.file", path)
+	v.Set("bypass_tokens.secret", "secret")
+	v.Set("rules", []map[string]interface{}{{"when": `path startswith "/static/"`, "action": "bypass"}})
+	require.NoError(t, ValidateProxyConfig(v))
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+
+	token, err := MintBypassToken("secret", time.Hour, 1, "")
+	require.NoError(t, err)
+	r := httptest.NewRequest("GET", "/static/app.js?v=2&qp_token="+token, nil)
+	r.Header.Set("X-QProxy-Token", token)
+	newProxyHandler(qp).ServeHTTP(httptest.NewRecorder(), r)
+
+	forwarded := <-received
+	assert.Equal(t, "/static/app.js?v=2", forwarded.RequestURI)
+	assert.Empty(t, forwarded.Header.Get("X-QProxy-Token"))
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"outcome":"bypassed"`)
+	assert.NotContains(t, string(b), token)
+}
@@ -0,0 +1,147 @@
+package qproxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The types below are the OTLP/HTTP JSON encoding of an export trace service
+// request, limited to the fields set by QProxy.
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func newOTLPAttribute(key string, value interface{}) otlpAttribute {
+	attribute := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case int:
+		intValue := strconv.Itoa(v)
+		attribute.Value.IntValue = &intValue
+	case float64:
+		attribute.Value.DoubleValue = &v
+	case bool:
+		attribute.Value.BoolValue = &v
+	default:
+		stringValue := fmt.Sprint(v)
+		attribute.Value.StringValue = &stringValue
+	}
+
+	return attribute
+}
+
+func formatUnixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func newOTLPSpan(s *span) otlpSpan {
+	encoded := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: formatUnixNano(s.start),
+		EndTimeUnixNano:   formatUnixNano(s.end),
+	}
+
+	if s.parentSpanID != [8]byte{} {
+		encoded.ParentSpanID = hex.EncodeToString(s.parentSpanID[:])
+	}
+
+	for _, attribute := range s.attributes {
+		encoded.Attributes = append(encoded.Attributes, newOTLPAttribute(attribute.key, attribute.value))
+	}
+
+	if s.failed {
+		encoded.Status = otlpStatus{Code: spanStatusError, Message: s.message}
+	}
+
+	return encoded
+}
+
+func newOTLPTraceRequest(serviceName string, spans []*span) *otlpTraceRequest {
+	scopeSpans := otlpScopeSpans{Scope: otlpScope{Name: "qproxy"}, Spans: make([]otlpSpan, 0, len(spans))}
+	for _, s := range spans {
+		scopeSpans.Spans = append(scopeSpans.Spans, newOTLPSpan(s))
+	}
+
+	return &otlpTraceRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource:   otlpResource{Attributes: []otlpAttribute{newOTLPAttribute("service.name", serviceName)}},
+			ScopeSpans: []otlpScopeSpans{scopeSpans},
+		}},
+	}
+}
+
+// sendSpans posts the spans to the OTLP/HTTP collector using the JSON
+// encoding.
+func sendSpans(config *tracingConfig, spans []*span) error {
+	payload, err := json.Marshal(newOTLPTraceRequest(config.serviceName, spans))
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: config.timeout}
+	resp, err := client.Post(config.endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Collector answered with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
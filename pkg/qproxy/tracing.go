@@ -0,0 +1,449 @@
+package qproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	traceparentHeader = "traceparent"
+
+	// maxRequestIDLength is the maximum length of a request ID received from
+	// the client, longer IDs are replaced.
+	maxRequestIDLength = 200
+)
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+// tracingConfig holds the tracing options, bufferSize is only applied when
+// QProxy is created.
+type tracingConfig struct {
+	endpoint        string
+	serviceName     string
+	sampleRate      float64
+	requestIDHeader string
+	timeout         time.Duration
+	batchSize       int
+	flushInterval   time.Duration
+	bufferSize      int
+}
+
+func newTracingConfig(v *viper.Viper) *tracingConfig {
+	v.SetDefault("tracing.service_name", "qproxy")
+	v.SetDefault("tracing.sample_rate", 1)
+	v.SetDefault("tracing.request_id_header", "X-Request-ID")
+	v.SetDefault("tracing.timeout", 5)
+	v.SetDefault("tracing.batch_size", 100)
+	v.SetDefault("tracing.flush_interval", 1)
+	v.SetDefault("tracing.buffer_size", 10000)
+
+	return &tracingConfig{
+		endpoint:        v.GetString("tracing.endpoint"),
+		serviceName:     v.GetString("tracing.service_name"),
+		sampleRate:      v.GetFloat64("tracing.sample_rate"),
+		requestIDHeader: v.GetString("tracing.request_id_header"),
+		timeout:         v.GetDuration("tracing.timeout") * time.Second,
+		batchSize:       v.GetInt("tracing.batch_size"),
+		flushInterval:   v.GetDuration("tracing.flush_interval") * time.Second,
+		bufferSize:      v.GetInt("tracing.buffer_size"),
+	}
+}
+
+func validateTracingConfig(v *viper.Viper) error {
+	if endpoint := v.GetString("tracing.endpoint"); endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Option `tracing.endpoint` must be an http or https URL")
+		}
+	}
+
+	if v.IsSet("tracing.sample_rate") {
+		if rate := v.GetFloat64("tracing.sample_rate"); rate < 0 || rate > 1 {
+			return errors.New("Option `tracing.sample_rate` must be between 0 and 1")
+		}
+	}
+
+	if v.IsSet("tracing.request_id_header") && v.GetString("tracing.request_id_header") == "" {
+		return errors.New("Option `tracing.request_id_header` must not be empty")
+	}
+
+	for _, key := range []string{"tracing.timeout", "tracing.batch_size", "tracing.flush_interval", "tracing.buffer_size"} {
+		if v.IsSet(key) && v.GetInt(key) <= 0 {
+			return fmt.Errorf("Option `%s` must be greater than 0", key)
+		}
+	}
+
+	return nil
+}
+
+// traceContext is the W3C trace context of a span.
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// parseTraceparent parses a W3C `traceparent` header, unknown versions are
+// accepted as long as they start with the version 00 fields.
+func parseTraceparent(value string) (traceContext, bool) {
+	tc := traceContext{}
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tc, false
+	}
+
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(parts) != 4) {
+		return tc, false
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return tc, false
+	}
+
+	if _, err := hex.Decode(tc.traceID[:], []byte(parts[1])); err != nil || tc.traceID == [16]byte{} {
+		return tc, false
+	}
+
+	if _, err := hex.Decode(tc.spanID[:], []byte(parts[2])); err != nil || tc.spanID == [8]byte{} {
+		return tc, false
+	}
+	tc.sampled = flags[0]&1 == 1
+
+	return tc, true
+}
+
+func (tc traceContext) traceparent() string {
+	flags := 0
+	if tc.sampled {
+		flags = 1
+	}
+
+	return fmt.Sprintf("00-%x-%x-%02x", tc.traceID, tc.spanID, flags)
+}
+
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+// span is a timed operation of a request, it is exported to the collector
+// once the request has been served.
+type span struct {
+	name         string
+	kind         int
+	traceID      [16]byte
+	spanID       [8]byte
+	parentSpanID [8]byte
+	start        time.Time
+	end          time.Time
+	attributes   []spanAttribute
+	failed       bool
+	message      string
+}
+
+func (s *span) setAttribute(key string, value interface{}) {
+	if s != nil {
+		s.attributes = append(s.attributes, spanAttribute{key: key, value: value})
+	}
+}
+
+func (s *span) setError(message string) {
+	if s != nil {
+		s.failed = true
+		s.message = message
+	}
+}
+
+func (s *span) finish() {
+	if s != nil && s.end.IsZero() {
+		s.end = time.Now()
+	}
+}
+
+// requestTrace is attached to the request context while it is served. The
+// request span covers the whole request, the queue span the time spent
+// deciding whether the client is admitted and the upstream spans each attempt
+// to proxy the request to a backend.
+type requestTrace struct {
+	requestID       string
+	requestIDHeader string
+	sampled         bool
+	recording       bool
+	root            *span
+	queue           *span
+	spans           []*span
+}
+
+func requestTraceFromContext(ctx context.Context) *requestTrace {
+	trace, _ := ctx.Value(requestTraceKey).(*requestTrace)
+
+	return trace
+}
+
+// newRequestTrace continues the trace of the `traceparent` header, or starts a
+// new one sampled according to the sample rate.
+func newRequestTrace(r *http.Request, config *tracingConfig, recording bool) *requestTrace {
+	trace := &requestTrace{
+		requestID:       r.Header.Get(config.requestIDHeader),
+		requestIDHeader: config.requestIDHeader,
+	}
+	if trace.requestID == "" || len(trace.requestID) > maxRequestIDLength {
+		trace.requestID = xid.New().String()
+	}
+
+	parent, ok := parseTraceparent(r.Header.Get(traceparentHeader))
+	if ok {
+		trace.sampled = parent.sampled
+	} else {
+		rand.Read(parent.traceID[:])
+		trace.sampled = config.sampleRate > 0 && mathrand.Float64() < config.sampleRate
+	}
+	trace.recording = recording && trace.sampled
+
+	trace.root = trace.newSpan("qproxy.request", spanKindServer, parent.traceID, parent.spanID)
+	trace.queue = trace.startSpan("qproxy.queue", spanKindInternal)
+
+	return trace
+}
+
+func (trace *requestTrace) newSpan(name string, kind int, traceID [16]byte, parentSpanID [8]byte) *span {
+	s := &span{
+		name:         name,
+		kind:         kind,
+		traceID:      traceID,
+		parentSpanID: parentSpanID,
+		start:        time.Now(),
+	}
+	rand.Read(s.spanID[:])
+	trace.spans = append(trace.spans, s)
+
+	return s
+}
+
+// startSpan starts a child span of the request span.
+func (trace *requestTrace) startSpan(name string, kind int) *span {
+	return trace.newSpan(name, kind, trace.root.traceID, trace.root.spanID)
+}
+
+// startUpstream ends the queue span and starts the span of an attempt to
+// proxy the request to the backend, the trace context and the request ID are
+// forwarded in the request headers.
+func (trace *requestTrace) startUpstream(r *http.Request, b *backend) *span {
+	if trace == nil {
+		return nil
+	}
+
+	trace.queue.finish()
+	upstream := trace.startSpan("qproxy.upstream", spanKindClient)
+	upstream.setAttribute("qproxy.backend", b.name)
+	upstream.setAttribute("http.url", b.url.String()+r.URL.Path)
+
+	r.Header.Set(traceparentHeader, traceContext{traceID: upstream.traceID, spanID: upstream.spanID, sampled: trace.sampled}.traceparent())
+	r.Header.Set(trace.requestIDHeader, trace.requestID)
+
+	return upstream
+}
+
+// finishUpstream ends the span of an attempt, failed attempts are marked as
+// errors.
+func (trace *requestTrace) finishUpstream(upstream *span, status int, err error) {
+	if trace == nil {
+		return
+	}
+
+	if err != nil {
+		upstream.setError(err.Error())
+	} else {
+		upstream.setAttribute("http.status_code", status)
+		if status >= http.StatusInternalServerError {
+			upstream.setError(http.StatusText(status))
+		}
+	}
+	upstream.finish()
+}
+
+// finish ends the request and queue spans, the outcome of the request is
+// taken from its access log entry.
+func (trace *requestTrace) finish(r *http.Request, clientIP string, status int, entry *accessLogEntry) {
+	trace.root.setAttribute("http.method", r.Method)
+	trace.root.setAttribute("http.host", r.Host)
+	trace.root.setAttribute("http.target", r.URL.Path)
+	trace.root.setAttribute("http.client_ip", clientIP)
+	trace.root.setAttribute("http.status_code", status)
+	trace.root.setAttribute("qproxy.request_id", trace.requestID)
+	if status >= http.StatusInternalServerError {
+		trace.root.setError(http.StatusText(status))
+	}
+
+	if entry != nil {
+		for _, s := range []*span{trace.root, trace.queue} {
+			s.setAttribute("qproxy.room", entry.Room)
+			s.setAttribute("qproxy.pool", entry.Pool)
+			s.setAttribute("qproxy.outcome", entry.Outcome)
+			if entry.Backend != "" {
+				s.setAttribute("qproxy.backend", entry.Backend)
+			}
+		}
+		if entry.Queued > 0 {
+			trace.queue.setAttribute("qproxy.queued", entry.Queued)
+		}
+	}
+
+	trace.queue.finish()
+	trace.root.finish()
+}
+
+// tracer propagates the trace context and the request ID of the proxied
+// requests and exports their spans to an OTLP/HTTP collector. Spans are
+// dropped instead of blocking the request when the buffer is full.
+type tracer struct {
+	dropped      uint64
+	atomicConfig atomic.Value
+	spans        chan *span
+	closing      chan struct{}
+	stopped      chan struct{}
+	closeOnce    sync.Once
+}
+
+func newTracer(config *tracingConfig) *tracer {
+	t := tracer{
+		spans:   make(chan *span, config.bufferSize),
+		closing: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	t.atomicConfig.Store(config)
+	go t.run()
+
+	return &t
+}
+
+func (t *tracer) config() *tracingConfig {
+	return t.atomicConfig.Load().(*tracingConfig)
+}
+
+func (t *tracer) configure(config *tracingConfig) {
+	t.atomicConfig.Store(config)
+}
+
+func (t *tracer) exporting() bool {
+	return t.config().endpoint != ""
+}
+
+// serveTraced serves the request with the handler and exports its spans when
+// the trace is sampled.
+func (t *tracer) serveTraced(rw http.ResponseWriter, r *http.Request, clientIP string, handler func(http.ResponseWriter, *http.Request)) {
+	config := t.config()
+	trace := newRequestTrace(r, config, t.exporting())
+	ctx := context.WithValue(r.Context(), requestTraceKey, trace)
+
+	entry := accessLogEntryFromContext(ctx)
+	if entry == nil && trace.recording {
+		entry = &accessLogEntry{}
+		ctx = context.WithValue(ctx, accessLogEntryKey, entry)
+	}
+	if entry != nil {
+		entry.RequestID = trace.requestID
+	}
+
+	recorder := newResponseRecorder(rw)
+	handler(recorder, r.WithContext(ctx))
+	if !trace.recording {
+		return
+	}
+
+	trace.finish(r, clientIP, recorder.status, entry)
+	for _, s := range trace.spans {
+		t.export(s)
+	}
+}
+
+func (t *tracer) export(s *span) {
+	select {
+	case t.spans <- s:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// run sends the spans by batches, the pending spans are sent on shutdown.
+func (t *tracer) run() {
+	defer close(t.stopped)
+
+	timer := time.NewTimer(t.config().flushInterval)
+	defer timer.Stop()
+
+	batch := make([]*span, 0)
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) >= t.config().batchSize {
+				batch = t.flush(batch)
+			}
+		case <-timer.C:
+			batch = t.flush(batch)
+			timer.Reset(t.config().flushInterval)
+		case <-t.closing:
+			for pending := true; pending; {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					pending = false
+				}
+			}
+			t.flush(batch)
+			return
+		}
+	}
+}
+
+// flush sends the batch and returns an empty batch, spans are dropped when
+// the collector can not be reached.
+func (t *tracer) flush(batch []*span) []*span {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	config := t.config()
+	if config.endpoint == "" {
+		return batch[:0]
+	}
+
+	if err := sendSpans(config, batch); err != nil {
+		proxyLog.WithFields(log.Fields{"error": err, "spans": len(batch)}).Error("Unable to export spans, spans dropped")
+	}
+
+	return make([]*span, 0, len(batch))
+}
+
+// shutdown sends the pending spans to the collector.
+func (t *tracer) shutdown() {
+	t.closeOnce.Do(func() {
+		close(t.closing)
+		<-t.stopped
+	})
+}
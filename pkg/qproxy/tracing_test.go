@@ -0,0 +1,141 @@
+package qproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.True(t, ok)
+	assert.True(t, tc.sampled)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", tc.traceparent())
+
+	tc, ok = parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	require.True(t, ok)
+	assert.False(t, tc.sampled)
+
+	for _, value := range []string{
+		"",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		_, ok := parseTraceparent(value)
+		assert.False(t, ok, value)
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	headers := make(chan http.Header, 2)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	v := newViper()
+	v.Set("backends.test.url", upstream.URL)
+	v.Set("backends.test.max_sessions", 2)
+	v.Set("backends.test.session_ttl", 5)
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	handler := newProxyHandler(qp)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.Header.Set("X-Request-ID", "request-1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	forwarded := <-headers
+	assert.Equal(t, "request-1", forwarded.Get("X-Request-ID"))
+	tc, ok := parseTraceparent(forwarded.Get("traceparent"))
+	require.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", strings.Split(forwarded.Get("traceparent"), "-")[1])
+	assert.NotEqual(t, "00f067aa0ba902b7", strings.Split(forwarded.Get("traceparent"), "-")[2])
+	assert.True(t, tc.sampled)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	forwarded = <-headers
+	assert.NotEmpty(t, forwarded.Get("X-Request-ID"))
+	_, ok = parseTraceparent(forwarded.Get("traceparent"))
+	assert.True(t, ok)
+}
+
+func TestTraceExport(t *testing.T) {
+	lock := sync.Mutex{}
+	spans := make(map[string]otlpSpan)
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		request := otlpTraceRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+
+		lock.Lock()
+		defer lock.Unlock()
+		assert.Equal(t, "edge", *request.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+		for _, s := range request.ResourceSpans[0].ScopeSpans[0].Spans {
+			spans[s.Name+"/"+s.TraceID] = s
+		}
+	}))
+	defer collector.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	v := newViper()
+	v.Set("backends.test.url", upstream.URL)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+	v.Set("tracing.endpoint", collector.URL+"/v1/traces")
+	v.Set("tracing.service_name", "edge")
+	require.NoError(t, ValidateProxyConfig(v))
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	handler := newProxyHandler(qp)
+
+	admitted := "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("traceparent", "00-"+admitted+"-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	queued := "5bf92f3577b34da6a3ce929d0e0e4736"
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("traceparent", "00-"+queued+"-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("traceparent", "00-6bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	qp.tracer.shutdown()
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, spans, 5)
+
+	request := spans["qproxy.request/"+admitted]
+	assert.Equal(t, "00f067aa0ba902b7", request.ParentSpanID)
+	assert.Equal(t, spanKindServer, request.Kind)
+	assert.Contains(t, request.Attributes, newOTLPAttribute("qproxy.outcome", outcomeAdmitted))
+	assert.Contains(t, request.Attributes, newOTLPAttribute("http.status_code", http.StatusOK))
+
+	call := spans["qproxy.upstream/"+admitted]
+	assert.Equal(t, request.SpanID, call.ParentSpanID)
+	assert.Equal(t, spanKindClient, call.Kind)
+	assert.Contains(t, call.Attributes, newOTLPAttribute("qproxy.backend", "test"))
+	assert.Equal(t, request.SpanID, spans["qproxy.queue/"+admitted].ParentSpanID)
+
+	queue := spans["qproxy.queue/"+queued]
+	assert.Contains(t, queue.Attributes, newOTLPAttribute("qproxy.outcome", outcomeQueued))
+	assert.NotContains(t, spans, "qproxy.upstream/"+queued)
+}
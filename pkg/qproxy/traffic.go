@@ -0,0 +1,200 @@
+package qproxy
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencySamples is the number of latest latencies used to compute the
+// latency percentiles of a backend.
+const latencySamples = 1024
+
+// BackendTrafficStatistics stores the traffic of a backend since Since
+type BackendTrafficStatistics struct {
+	Since          string
+	Requests       uint64
+	StatusClasses  map[string]uint64
+	BytesIn        uint64
+	BytesOut       uint64
+	UpstreamErrors uint64
+	Admissions     uint64
+	Expirations    uint64
+
+	AverageLatency string
+	P50Latency     string
+	P95Latency     string
+	P99Latency     string
+}
+
+// backendTraffic collects the traffic of a backend, it survives configuration
+// reloads and may be reset.
+type backendTraffic struct {
+	lock           sync.Mutex
+	since          time.Time
+	requests       uint64
+	statusClasses  [5]uint64
+	bytesIn        uint64
+	bytesOut       uint64
+	upstreamErrors uint64
+	admissions     uint64
+	expirations    uint64
+	latencySum     time.Duration
+	latencies      []time.Duration
+	nextLatency    int
+}
+
+func newBackendTraffic() *backendTraffic {
+	t := backendTraffic{}
+	t.reset()
+
+	return &t
+}
+
+func (t *backendTraffic) reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.since = time.Now()
+	t.requests = 0
+	t.statusClasses = [5]uint64{}
+	t.bytesIn, t.bytesOut = 0, 0
+	t.upstreamErrors = 0
+	t.admissions, t.expirations = 0, 0
+	t.latencySum = 0
+	t.latencies = make([]time.Duration, 0, latencySamples)
+	t.nextLatency = 0
+}
+
+func (t *backendTraffic) observe(status int, bytesIn uint64, bytesOut uint64, latency time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.requests++
+	if class := status/100 - 1; class >= 0 && class < len(t.statusClasses) {
+		t.statusClasses[class]++
+	}
+	t.bytesIn += bytesIn
+	t.bytesOut += bytesOut
+	t.latencySum += latency
+
+	if len(t.latencies) < latencySamples {
+		t.latencies = append(t.latencies, latency)
+		return
+	}
+	t.latencies[t.nextLatency] = latency
+	t.nextLatency = (t.nextLatency + 1) % latencySamples
+}
+
+func (t *backendTraffic) countUpstreamError() {
+	t.lock.Lock()
+	t.upstreamErrors++
+	t.lock.Unlock()
+}
+
+func (t *backendTraffic) countAdmissions(count int) {
+	t.lock.Lock()
+	t.admissions += uint64(count)
+	t.lock.Unlock()
+}
+
+func (t *backendTraffic) countExpirations(count int) {
+	t.lock.Lock()
+	t.expirations += uint64(count)
+	t.lock.Unlock()
+}
+
+func (t *backendTraffic) statistics() BackendTrafficStatistics {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	statistics := BackendTrafficStatistics{
+		Since:          t.since.Format(time.RFC3339),
+		Requests:       t.requests,
+		StatusClasses:  make(map[string]uint64),
+		BytesIn:        t.bytesIn,
+		BytesOut:       t.bytesOut,
+		UpstreamErrors: t.upstreamErrors,
+		Admissions:     t.admissions,
+		Expirations:    t.expirations,
+	}
+
+	for i, count := range t.statusClasses {
+		statistics.StatusClasses[string('1'+rune(i))+"xx"] = count
+	}
+
+	var average time.Duration
+	if t.requests > 0 {
+		average = t.latencySum / time.Duration(t.requests)
+	}
+	statistics.AverageLatency = average.String()
+
+	latencies := append([]time.Duration(nil), t.latencies...)
+	sort.Slice(latencies, func(i int, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	statistics.P50Latency = percentile(latencies, 0.50).String()
+	statistics.P95Latency = percentile(latencies, 0.95).String()
+	statistics.P99Latency = percentile(latencies, 0.99).String()
+
+	return statistics
+}
+
+// percentile returns the nearest-rank percentile of sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(p*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+
+	return sorted[rank]
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	bytes uint64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += uint64(n)
+
+	return n, err
+}
+
+// serveObserved proxies the request with the handler and records its traffic,
+// requests retried on another backend are only counted as upstream errors.
+func (t *backendTraffic) serveObserved(rw http.ResponseWriter, r *http.Request, handler http.Handler) {
+	start := time.Now()
+	recorder := newResponseRecorder(rw)
+
+	var body *countingReader
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &countingReader{ReadCloser: r.Body}
+		r = r.Clone(r.Context())
+		r.Body = body
+	}
+
+	handler.ServeHTTP(recorder, r)
+
+	// The request is retried on another backend, it is counted there
+	if attempt, ok := r.Context().Value(proxyAttemptKey).(*proxyAttempt); ok && attempt.err != nil {
+		return
+	}
+
+	var bytesIn uint64
+	if body != nil {
+		bytesIn = body.bytes
+	}
+	t.observe(recorder.status, bytesIn, uint64(recorder.bytes), time.Since(start))
+}
@@ -0,0 +1,92 @@
+package qproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendTraffic(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/missing" {
+			rw.WriteHeader(http.StatusNotFound)
+		}
+		rw.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	v := newViper()
+	v.Set("backends.test.url", upstream.URL)
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+	handler := newProxyHandler(qp)
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("POST", "/", strings.NewReader("payload")))
+	require.Equal(t, http.StatusOK, rw.Code)
+
+	r := httptest.NewRequest("GET", "/missing", nil)
+	for _, cookie := range rw.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	traffic := qp.syncStatistics().Backends[0].Traffic
+	assert.Equal(t, uint64(2), traffic.Requests)
+	assert.Equal(t, uint64(1), traffic.StatusClasses["2xx"])
+	assert.Equal(t, uint64(1), traffic.StatusClasses["4xx"])
+	assert.Equal(t, uint64(7), traffic.BytesIn)
+	assert.Equal(t, uint64(10), traffic.BytesOut)
+	assert.Equal(t, uint64(1), traffic.Admissions)
+	assert.Equal(t, uint64(0), traffic.UpstreamErrors)
+
+	rw = httptest.NewRecorder()
+	newAPIHandler(qp).ServeHTTP(rw, httptest.NewRequest("GET", "/statistics/reset", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+
+	rw = httptest.NewRecorder()
+	newAPIHandler(qp).ServeHTTP(rw, httptest.NewRequest("POST", "/statistics/reset", nil))
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	assert.Equal(t, uint64(0), qp.syncStatistics().Backends[0].Traffic.Requests)
+}
+
+func TestBackendTrafficUpstreamErrors(t *testing.T) {
+	v := newViper()
+	v.Set("backends.test.url", "http://127.0.0.1:1")
+	v.Set("backends.test.max_sessions", 1)
+	v.Set("backends.test.session_ttl", 5)
+
+	qp, err := NewQProxy(v)
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	newProxyHandler(qp).ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+
+	traffic := qp.syncStatistics().Backends[0].Traffic
+	assert.Equal(t, uint64(1), traffic.UpstreamErrors)
+	assert.Equal(t, uint64(1), traffic.StatusClasses["5xx"])
+}
+
+func TestBackendTrafficLatencyPercentiles(t *testing.T) {
+	traffic := newBackendTraffic()
+	for i := 1; i <= 100; i++ {
+		traffic.observe(http.StatusOK, 0, 0, time.Duration(i)*time.Millisecond)
+	}
+
+	statistics := traffic.statistics()
+	assert.Equal(t, "50.5ms", statistics.AverageLatency)
+	assert.Equal(t, "50ms", statistics.P50Latency)
+	assert.Equal(t, "95ms", statistics.P95Latency)
+	assert.Equal(t, "99ms", statistics.P99Latency)
+}